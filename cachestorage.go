@@ -5,6 +5,7 @@ const (
   KeyAlreadyInUse
   KeyNotFound
   IllegalParameter
+  TooLarge
 )
 
 type ErrorCode uint;
@@ -15,10 +16,24 @@ type StorageEntry struct {
   bytes      uint32
   cas_unique uint64
   content    []byte
+  access     ItemAccess  // kept by MapCacheStorage, read with accessInfo
+}
+
+/* When and how often an item was used, times in seconds. Entries are shared by the
+   readers fetching them, so these fields are only read and written atomically */
+type ItemAccess struct {
+  created  uint32  // when the item was stored
+  accessed uint32  // when it was last fetched, touched or written
+  previous uint32  // when it was accessed before that
+  fetches  uint32  // times it was fetched since it was stored
+  fetched  uint32  // times it was fetched since its value was last written
 }
 
 type CacheStorageFactory func() CacheStorage
 
+// Called for each live entry while iterating a storage. Returning false stops the iteration.
+type EntryVisitor func(key string, entry *StorageEntry) bool
+
 type CacheStorage interface {
 
   // Store this data.
@@ -30,10 +45,11 @@ type CacheStorage interface {
   // Store this data, but only if the server *does* already hold data for this key
   Replace(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (err ErrorCode, previous *StorageEntry, result *StorageEntry)
 
-  // Add this data to an existing key after existing data
+  // Add this data to an existing key after existing data. Fails with TooLarge when
+  // the value would outgrow the max item size.
   Append(key string, bytes uint32, content []byte) (err ErrorCode, previous *StorageEntry, result *StorageEntry)
 
-  // Add this data to an existing key before existing data
+  // Add this data to an existing key before existing data, failing like Append
   Prepend(key string, bytes uint32, content []byte) (err ErrorCode, previous *StorageEntry, result *StorageEntry)
 
   // Check and set (CAS) operation which means "store this data but
@@ -43,9 +59,20 @@ type CacheStorage interface {
   // Retrieve the stored data for a given key 
   Get(key string) (err ErrorCode, result *StorageEntry)
 
+  // Retrieve the stored data for a given key without counting it as a fetch, for reads
+  // done by the server itself
+  Peek(key string) (err ErrorCode, result *StorageEntry)
+
+  // Retrieve the stored data for several keys at once, in the same order. Missing keys get nil
+  GetMulti(keys []string) []*StorageEntry
+
   // Delete the stored data for a given key 
   Delete(key string) (err ErrorCode, deleted *StorageEntry)
 
+  // Delete the stored data for a given key, but only if no one else has updated it since
+  // it was fetched with this cas_unique
+  CasDelete(key string, cas_unique uint64) (err ErrorCode, deleted *StorageEntry)
+
   // Change data for some item in-place, incrementing or decrementing it.
   // The data for the item is treated as decimal representation of a 64-bit unsigned integer.  
   // If the current data value does not conform to such a representation, returns an error.
@@ -53,5 +80,13 @@ type CacheStorage interface {
   // that a non-existent key exists with value 0; instead, they will fail. 
   Incr(key string, value uint64, incr bool) (err ErrorCode, previous *StorageEntry, result *StorageEntry)
 
-  Expire(key string, check bool)
+  // Update the expiration time of an existing item
+  Touch(key string, exptime uint32) (err ErrorCode, previous *StorageEntry, result *StorageEntry)
+
+  // Remove an entry, only if it already expired when check is set. Returns whether it was removed
+  Expire(key string, check bool) bool
+
+  // Visit every stored entry, including expired ones not removed yet. The visitor runs while the
+  // storage (or the current partition) is locked, so it must not block nor call back into the storage.
+  Iterate(visitor EntryVisitor)
 }
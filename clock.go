@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Source of the current time for everything depending on it, so that tests can
+// drive it by hand instead of waiting.
+type Clock interface {
+	// Current time in seconds since the epoch
+	Seconds() int64
+	// Wait for ns nanoseconds of this clock
+	Sleep(ns int64)
+}
+
+// The system clock
+type systemClock struct{}
+
+func (self systemClock) Seconds() int64 {
+	return time.Seconds()
+}
+
+func (self systemClock) Sleep(ns int64) {
+	time.Sleep(ns)
+}
+
+// Server clock, as memcached's current_time: the seconds elapsed since the process
+// started on an underlying clock, plus a skew set by the debug command. It never goes
+// backwards, even if the underlying clock does, so an entry can't come back to life
+// once expired. It isn't a monotonic clock though: the underlying one is the wall
+// clock, so after it jumps back this one stands still until it catches up. Expiration times are kept as its times, which StorageEntry.expired
+// compares against.
+type ServerClock struct {
+	clock   Clock
+	started int64 // when the process started, in seconds since the epoch
+	skew    int64 // seconds added to the underlying clock
+	current int64 // latest seconds elapsed since started
+}
+
+// the clock of the server, shared by the storage, the expirers and the sessions
+var serverClock = newServerClock(systemClock{})
+
+// server clock skewed by the debug command, nil unless debug commands are enabled
+var debugClock *ServerClock
+
+func newServerClock(clock Clock) *ServerClock {
+	return &ServerClock{clock: clock, started: clock.Seconds()}
+}
+
+func (self *ServerClock) Seconds() int64 {
+	elapsed := self.clock.Seconds() + atomic.AddInt64(&self.skew, 0) - self.started
+	for {
+		current := atomic.AddInt64(&self.current, 0)
+		if elapsed <= current {
+			return self.started + current
+		} else if atomic.CompareAndSwapInt64(&self.current, current, elapsed) {
+			return self.started + elapsed
+		}
+	}
+	return self.started + elapsed
+}
+
+func (self *ServerClock) Sleep(ns int64) {
+	self.clock.Sleep(ns)
+}
+
+// Move the clock seconds ahead, or behind which only stops it until the underlying
+// clock catches up. Returns the new time.
+func (self *ServerClock) Skew(seconds int64) int64 {
+	atomic.AddInt64(&self.skew, seconds)
+	return self.Seconds()
+}
+
+// largest relative expiration time, larger ones are absolute unix times
+const secondsInMonth = 60 * 60 * 24 * 30
+
+// Expiration time for an exptime given by a client at now, as memcached does: 0 never
+// expires, negative ones are expired already, up to 30 days are relative to now, and
+// larger ones are absolute unix times. Expired ones become now, as it'd be taken for
+// an absolute time if sent to a peer.
+func expirationTime(exptime int64, now int64) uint32 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return uint32(now)
+	case exptime <= secondsInMonth:
+		return uint32(now + exptime)
+	}
+	return uint32(exptime)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// Clock moved by hand, for tests. Sleeping waits until the clock is advanced enough.
+type ManualClock struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	now  int64 // nanoseconds since the epoch
+}
+
+func newManualClock(seconds int64) *ManualClock {
+	clock := &ManualClock{now: seconds * 1e9}
+	clock.cond = sync.NewCond(&clock.lock)
+	return clock
+}
+
+func (self *ManualClock) Seconds() int64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.now / 1e9
+}
+
+func (self *ManualClock) Sleep(ns int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for until := self.now + ns; self.now < until; {
+		self.cond.Wait()
+	}
+}
+
+// Move the clock ns nanoseconds ahead, or behind if negative
+func (self *ManualClock) Advance(ns int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.now += ns
+	self.cond.Broadcast()
+}
+
+// a clock started long after 30 days since the epoch, so relative and absolute
+// exptimes differ
+const manualStart = 1300000000
+
+func TestExpirationTime(t *testing.T) {
+	now := int64(manualStart)
+	exptimes := []struct {
+		exptime  int64
+		expected int64
+	}{
+		{0, 0},
+		{-1, now},
+		{-secondsInMonth * 2, now},
+		{1, now + 1},
+		{secondsInMonth, now + secondsInMonth},
+		{secondsInMonth + 1, secondsInMonth + 1},
+		{now + 1000, now + 1000},
+	}
+	for _, e := range exptimes {
+		if got := int64(expirationTime(e.exptime, now)); got != e.expected {
+			t.Errorf("%d: expected %d, got %d", e.exptime, e.expected, got)
+		}
+	}
+	if entry := (&StorageEntry{exptime: expirationTime(-1, now)}); !entry.expired(uint32(now)) {
+		t.Error("Expected a negative exptime to be expired already")
+	}
+}
+
+func TestServerClockNeverGoesBack(t *testing.T) {
+	base := newManualClock(manualStart)
+	clock := newServerClock(base)
+	base.Advance(10e9)
+	assertEquals(t, clock.Seconds(), int64(manualStart+10), "server clock not following its clock")
+	base.Advance(-5e9)
+	assertEquals(t, clock.Seconds(), int64(manualStart+10), "server clock went back")
+	base.Advance(6e9)
+	assertEquals(t, clock.Seconds(), int64(manualStart+11), "server clock not catching up")
+	assertEquals(t, clock.Skew(100), int64(manualStart+111), "server clock not skewed ahead")
+	assertEquals(t, clock.Skew(-100), int64(manualStart+111), "server clock skewed back")
+}
+
+func TestEntriesExpireWithTheClock(t *testing.T) {
+	clock := newManualClock(manualStart)
+	storage := newMapCacheStorage(clock)
+	storage.Set("soon", 0, expirationTime(10, clock.Seconds()), 1, []byte("a"))
+	clock.Advance(9e9)
+	if err, _ := storage.Get("soon"); err != Ok {
+		t.Error("Entry expired early")
+	}
+	clock.Advance(1e9)
+	if err, _ := storage.Get("soon"); err != KeyNotFound {
+		t.Error("Entry didn't expire")
+	}
+}
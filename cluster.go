@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// seconds between membership exchanges with the known members
+	clusterSyncInterval = 10
+	// entries sent to a peer before waiting for its replies during a handoff
+	handoffBatchSize = 100
+)
+
+// Peer awareness for a gocached node. Members are discovered from a static seed list
+// and by exchanging member lists, and every node builds the same HashRing out of them.
+// A joining node asks every member to hand off the entries it now owns, and only
+// starts serving clients once all of them are done.
+type Cluster struct {
+	self    string
+	seeds   []string
+	storage CacheStorage
+	clock   Clock
+	mutex   sync.RWMutex
+	members map[string]bool
+	ring    *HashRing
+	serving bool
+	// handoffs running to each member, whose keys can't be written meanwhile
+	handoffs map[string]int
+}
+
+func newCluster(self string, seeds []string, storage CacheStorage, clock Clock) *Cluster {
+	c := &Cluster{self: self, seeds: seeds, storage: storage, clock: clock, members: map[string]bool{self: true},
+		handoffs: make(map[string]int)}
+	c.ring = newHashRing(c.memberList())
+	return c
+}
+
+// Join the cluster through the seeds and wait for the handoffs, then keep exchanging
+// member lists in background.
+func (self *Cluster) Start() {
+	self.join()
+	self.mutex.Lock()
+	self.serving = true
+	self.mutex.Unlock()
+	logger.Info("Serving as cluster member", "self", self.self, "members", strings.Join(self.Members(), ","))
+	go self.syncLoop()
+}
+
+// Whether the node finished joining and may serve client requests
+func (self *Cluster) Serving() bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.serving
+}
+
+func (self *Cluster) Members() []string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.ring.Members()
+}
+
+// Owner of a key according to the current ring
+func (self *Cluster) Owner(key string) string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.ring.Owner(key)
+}
+
+// Whether the entry of key is being handed off to its owner. Writing it meanwhile
+// could be lost, as the owner may have got the entry before the write.
+func (self *Cluster) HandingOff(key string) bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return len(self.handoffs) > 0 && self.handoffs[self.ring.Owner(key)] > 0
+}
+
+// Add members to the ring, returns whether any of them was new
+func (self *Cluster) AddMembers(members []string) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	changed := false
+	for _, member := range members {
+		if member != "" && !self.members[member] {
+			self.members[member] = true
+			changed = true
+		}
+	}
+	if changed {
+		self.ring = newHashRing(self.memberList())
+		logger.Info("Cluster members changed", "members", strings.Join(self.ring.Members(), ","))
+	}
+	return changed
+}
+
+// must be called with the mutex held
+func (self *Cluster) memberList() []string {
+	list := make([]string, 0, len(self.members))
+	for member, _ := range self.members {
+		list = append(list, member)
+	}
+	return list
+}
+
+// Announce this node to every reachable member until no new members show up,
+// then ask each of them for the entries this node now owns.
+func (self *Cluster) join() {
+	contacted := map[string]bool{self.self: true}
+	pending := self.seeds
+	for len(pending) > 0 {
+		var discovered []string
+		for _, member := range pending {
+			if contacted[member] {
+				continue
+			}
+			contacted[member] = true
+			if members, err := self.requestMembers(member, "cluster join "+self.self); err != nil {
+				logger.Error("Unable to join cluster", "member", member, "err", err)
+			} else {
+				self.AddMembers(members)
+				discovered = append(discovered, members...)
+			}
+		}
+		pending = discovered
+	}
+	for _, member := range self.Members() {
+		if member == self.self {
+			continue
+		}
+		if reply, err := requestPeer(member, "cluster handoff "+self.self); err != nil {
+			logger.Error("Handoff failed", "member", member, "err", err)
+		} else {
+			logger.Info("Handoff done", "member", member, "reply", reply)
+		}
+	}
+}
+
+func (self *Cluster) syncLoop() {
+	for {
+		self.clock.Sleep(1e9 * clusterSyncInterval)
+		for _, member := range self.Members() {
+			if member == self.self {
+				continue
+			}
+			if members, err := self.requestMembers(member, "cluster members"); err == nil {
+				self.AddMembers(members)
+			}
+		}
+	}
+}
+
+func (self *Cluster) requestMembers(member string, request string) ([]string, os.Error) {
+	reply, err := requestPeer(member, request)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(reply)
+	if len(fields) == 0 || fields[0] != "MEMBERS" {
+		return nil, os.NewError("unexpected reply: " + reply)
+	}
+	return fields[1:], nil
+}
+
+type handoffEntry struct {
+	key   string
+	entry *StorageEntry
+}
+
+// Send every entry owned by target to it, and drop it from the local storage once
+// the target stored it, unless it changed since. Client writes to those keys are
+// refused meanwhile. Returns the amount of entries migrated.
+func (self *Cluster) Handoff(target string) (int, os.Error) {
+	self.AddMembers([]string{target})
+	self.mutex.Lock()
+	ring := self.ring
+	self.handoffs[target] += 1
+	self.mutex.Unlock()
+	defer func() {
+		self.mutex.Lock()
+		if self.handoffs[target] -= 1; self.handoffs[target] == 0 {
+			self.handoffs[target] = 0, false
+		}
+		self.mutex.Unlock()
+	}()
+
+	var entries []handoffEntry
+	now := uint32(self.clock.Seconds())
+	self.storage.Iterate(func(key string, entry *StorageEntry) bool {
+		if !entry.expired(now) && ring.Owner(key) == target {
+			entries = append(entries, handoffEntry{key, entry})
+		}
+		return true
+	})
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	peer, err := dialPeer(target)
+	if err != nil {
+		return 0, err
+	}
+	defer peer.conn.Close()
+	if reply, err := peer.request("cluster peer"); err != nil {
+		return 0, err
+	} else if reply != "OK" {
+		return 0, os.NewError("unexpected reply: " + reply)
+	}
+	migrated := 0
+	for start := 0; start < len(entries); start += handoffBatchSize {
+		end := start + handoffBatchSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		batch := entries[start:end]
+		for _, e := range batch {
+			fmt.Fprintf(peer.writer, "set %s %d %d %d\r\n", e.key, e.entry.flags, e.entry.exptime, e.entry.bytes)
+			peer.writer.Write(e.entry.content)
+			peer.writer.WriteString("\r\n")
+		}
+		if err := peer.writer.Flush(); err != nil {
+			return migrated, err
+		}
+		for _, e := range batch {
+			if reply, err := peer.readLine(); err != nil {
+				return migrated, err
+			} else if reply == "STORED" {
+				if err, _ := self.storage.CasDelete(e.key, e.entry.cas_unique); err == Ok {
+					migrated += 1
+				}
+			}
+		}
+	}
+	return migrated, nil
+}
+
+// A text protocol connection to another member
+type peerConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func dialPeer(addr string) (*peerConn, os.Error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &peerConn{conn, bufio.NewReader(conn), bufio.NewWriter(conn)}, nil
+}
+
+func (self *peerConn) request(line string) (string, os.Error) {
+	if _, err := self.writer.WriteString(line + "\r\n"); err != nil {
+		return "", err
+	}
+	if err := self.writer.Flush(); err != nil {
+		return "", err
+	}
+	return self.readLine()
+}
+
+func (self *peerConn) readLine() (string, os.Error) {
+	line, _, err := self.reader.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	return string(line), nil
+}
+
+// Send a single request line to a member on a new connection and return its reply
+func requestPeer(addr string, line string) (string, os.Error) {
+	peer, err := dialPeer(addr)
+	if err != nil {
+		return "", err
+	}
+	defer peer.conn.Close()
+	return peer.request(line)
+}
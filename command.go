@@ -4,20 +4,43 @@ import (
   "os"
   "net"
   "bufio"
+  "bytes"
   "strings"
   "strconv"
   "time"
   "fmt"
+  "sync"
+  "flag"
+  "io"
+  "io/ioutil"
 )
 
 type Session struct {
-  conn      *net.TCPConn
+  conn      *sessionConn
   bufreader *bufio.Reader
   storage CacheStorage
+  clock Clock  // telling the time exptimes are relative to
+  peer bool  // connection from another cluster member
+  writeLock sync.Mutex  // held while writing a whole reply, as invalidations are pushed concurrently
+  watches *sessionWatches  // keys watched by a near cache, guarded by the WatchRegistry
+  keys []string  // keys of the command being run, for the slow log
+  bytes uint64  // value bytes stored or retrieved by the command being run
+  tokens [][]byte  // tokens of the line being run, pointing into the read buffer
+  longLine []byte  // copy of the line being run when it doesn't fit in the read buffer
+  header bytes.Buffer  // VALUE line being written
+  oneKey [1]string  // backs keys for single key commands
+  // the most frequent commands are reused by every request, so parsing them
+  // allocates nothing besides the keys and values stored
+  storageCommand StorageCommand
+  retrievalCommand RetrievalCommand
+  deleteCommand DeleteCommand
+  touchCommand TouchCommand
+  incrCommand IncrCommand
 }
 
+/* Parses its tokens, which are only valid until the session reads again */
 type Command interface {
-  parse(line []string) bool
+  parse(line [][]byte) bool
   Exec()
 }
 
@@ -39,6 +62,12 @@ type RetrievalCommand struct {
   keys     []string
 }
 
+type MetaGetCommand struct {
+  session     *Session
+  key         string
+  flags       []string  // return flags, each a letter and its token if any
+}
+
 type DeleteCommand struct {
   session     *Session
   command     string
@@ -62,6 +91,53 @@ type IncrCommand struct {
   noreply bool
 }
 
+type ClusterCommand struct {
+  session *Session
+  subcommand string
+  args []string
+}
+
+type WatchCommand struct {
+  session *Session
+  command string
+  stream bool  // "watch_mutations [prefix...]", the keys are prefixes
+  keys []string
+}
+
+type StatsCommand struct {
+  session *Session
+  args []string
+  limit int  // items dumped by cachedump
+}
+
+type RepartitionCommand struct {
+  session *Session
+  size uint32
+}
+
+type ConfigCommand struct {
+  session *Session
+  subcommand string
+  args []string
+}
+
+type VerbosityCommand struct {
+  session *Session
+  level string
+  noreply bool
+}
+
+type SlowlogCommand struct {
+  session *Session
+  subcommand string
+  count int
+}
+
+type DebugCommand struct {
+  session *Session
+  skew int64
+}
+
 type UnknownCommand struct {
   session *Session
   command string
@@ -79,55 +155,251 @@ const (
   ServerError
 )
 
-func NewSession(conn *net.TCPConn, store CacheStorage) (*Session, os.Error) {
-  var s = &Session{conn, bufio.NewReader(conn), store}
+func NewSession(conn *net.TCPConn, store CacheStorage, clock Clock) (*Session, os.Error) {
+  var s = &Session{conn: &sessionConn{TCPConn: conn}, bufreader: bufio.NewReader(conn), storage: store, clock: clock}
   return s, nil
 }
 
 
-/* Read a line and tokenize it */
-func getTokenizedLine(r *bufio.Reader) []string {
-  if rawline, _, err := r.ReadLine(); err == nil {
-    return strings.Fields(string(rawline))
+/* longest command line, longer ones are discarded as invalid commands */
+const maxLineLength = 1 << 20
+
+/* Read a line and split it in tokens, returns false at the end of the connection.
+   The tokens point into the read buffer and stay valid until the next read */
+func (s *Session) readTokens() ([][]byte, bool) {
+  line, err := s.bufreader.ReadSlice('\n')
+  if err == bufio.ErrBufferFull {
+    s.longLine = append(s.longLine[:0], line...)
+    tooLong := false
+    for err == bufio.ErrBufferFull {
+      line, err = s.bufreader.ReadSlice('\n')
+      tooLong = tooLong || len(s.longLine) + len(line) > maxLineLength
+      if !tooLong {
+        s.longLine = append(s.longLine, line...)
+      }
+    }
+    line = s.longLine
+    if tooLong {
+      line = nil
+    }
   }
-  return nil
+  if err != nil && len(line) == 0 {
+    return nil, false
+  }
+  tokens, start := s.tokens[:0], -1
+  for i, c := range line {
+    if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+      if start < 0 {
+        start = i
+      }
+    } else if start >= 0 {
+      tokens = append(tokens, line[start:i])
+      start = -1
+    }
+  }
+  if start >= 0 {
+    tokens = append(tokens, line[start:])
+  }
+  s.tokens = tokens
+  return tokens, true
 }
 
+var space = []byte(" ")
 
 func (s *Session) CommandLoop() {
 
-  for line := getTokenizedLine(s.bufreader);
-      line != nil; line = getTokenizedLine(s.bufreader) {
-    var cmd Command = cmdSelect(line[0], s)
+  for line, ok := s.readTokens(); ok; line, ok = s.readTokens() {
+    if len(line) == 0 {
+      s.writeLock.Lock()
+      Error(s, InvalidCommand, "")
+      s.writeLock.Unlock()
+      continue
+    }
+    cmd, name := cmdSelect(line[0], s)
+    request := ""
+    if logger.Enabled(LogTrace) {
+      // parsing may read past the line
+      request = string(bytes.Join(line, space))
+    }
+    s.writeLock.Lock()
+    s.conn.reply = ""
+    s.keys, s.bytes = nil, 0
+    elapsed := int64(-1)
     if cmd.parse(line) {
-      cmd.Exec()
+      if _, isCluster := cmd.(*ClusterCommand); !isCluster && !s.serving() {
+        Error(s, ServerError, "node is joining the cluster")
+      } else {
+        start := time.Nanoseconds()
+        cmd.Exec()
+        elapsed = time.Nanoseconds() - start
+      }
     }
+    recordCommand(name, cmd, s.conn.reply, elapsed)
+    if elapsed >= 0 {
+      recordLatency(name, elapsed)
+      recordSlow(s, name, elapsed)
+    }
+    if request != "" {
+      logger.Trace("Request", "client", s.conn.RemoteAddr(), "command", request,
+        "reply", s.conn.reply, "elapsed_us", elapsed / 1e3)
+    }
+    s.writeLock.Unlock()
+  }
+  watches.Close(s)
+}
+
+/* whether client requests may be served, peers are always served */
+func (s *Session) serving() bool {
+  return cluster == nil || s.peer || cluster.Serving()
+}
+
+/* refuse a client write to a key being handed off to another member */
+func (s *Session) handingOff(key string) bool {
+  if cluster == nil || s.peer || !cluster.HandingOff(key) {
+    return false
+  }
+  Error(s, ServerError, "key is being handed off")
+  return true
+}
+
+/* every command name, to find it without allocating a string for the token */
+var commandNames = make(map[string]string)
+
+func init() {
+  for _, name := range []string{"set", "add", "replace", "append", "prepend", "cas",
+      "get", "gets", "mg", "delete", "touch", "incr", "decr", "watch", "unwatch", "watch_mutations", "cluster",
+      "stats", "config", "repartition", "verbosity", "slowlog", "debug", "flush_all", "version", "quit"} {
+    commandNames[name] = name
   }
 }
 
-func cmdSelect(name string, s *Session) Command {
+/* the command for the first token of a line and its name */
+func cmdSelect(token []byte, s *Session) (Command, string) {
 
+    name, known := commandNames[string(token)]
+    if !known {
+      name = string(token)
+      return &UnknownCommand{session: s, command: name}, name
+    }
     switch name {
 
     case "set", "add", "replace", "append", "prepend", "cas":
-      return &StorageCommand{session: s}
+      s.storageCommand = StorageCommand{session: s, command: name}
+      return &s.storageCommand, name
     case "get", "gets":
-      return &RetrievalCommand{session: s}
+      s.retrievalCommand = RetrievalCommand{session: s, command: name, keys: s.retrievalCommand.keys[:0]}
+      return &s.retrievalCommand, name
+    case "mg":
+      return &MetaGetCommand{session: s}, name
     case "delete":
-      return &DeleteCommand{session: s}
+      s.deleteCommand = DeleteCommand{session: s, command: name}
+      return &s.deleteCommand, name
     case "touch":
-      return &TouchCommand{session: s}
+      s.touchCommand = TouchCommand{session: s, command: name}
+      return &s.touchCommand, name
     case "incr", "decr":
-      return &IncrCommand{session: s}
-    case "stats", "flush_all", "version", "quit":
-      return &UninmplementedCommand{session: s, command: name}
-    default:
-      return &UnknownCommand{session: s, command: name}
+      s.incrCommand = IncrCommand{session: s, incr: name == "incr"}
+      return &s.incrCommand, name
+    case "watch", "unwatch", "watch_mutations":
+      return &WatchCommand{session: s}, name
+    case "cluster":
+      return &ClusterCommand{session: s}, name
+    case "stats":
+      return &StatsCommand{session: s}, name
+    case "config":
+      return &ConfigCommand{session: s}, name
+    case "repartition":
+      return &RepartitionCommand{session: s}, name
+    case "verbosity":
+      return &VerbosityCommand{session: s}, name
+    case "slowlog":
+      return &SlowlogCommand{session: s}, name
+    case "debug":
+      return &DebugCommand{session: s}, name
     }
-  //not reaching here
-  return nil
+    return &UninmplementedCommand{session: s, command: name}, name
+}
+
+/* tokens as strings, for the commands whose parsing may allocate */
+func tokenStrings(tokens [][]byte) []string {
+  line := make([]string, len(tokens))
+  for i, token := range tokens {
+    line[i] = string(token)
+  }
+  return line
+}
+
+/* parse a decimal number as strconv.Atoui64 does, without allocating */
+func parseUint(token []byte) (uint64, bool) {
+  if len(token) == 0 {
+    return 0, false
+  }
+  var n uint64
+  for _, c := range token {
+    if c < '0' || c > '9' {
+      return 0, false
+    }
+    digit := uint64(c - '0')
+    if n > (1<<64 - 1 - digit) / 10 {
+      return 0, false
+    }
+    n = n * 10 + digit
+  }
+  return n, true
+}
+
+/* parse an exptime, a decimal number that may be negative and fits in 32 bits as in memcached */
+func parseExptime(token []byte) (int64, bool) {
+  negative := len(token) > 0 && token[0] == '-'
+  if negative {
+    token = token[1:]
+  }
+  n, ok := parseUint(token)
+  if !ok || n > 1<<31 || n == 1<<31 && !negative {
+    return 0, false
+  } else if negative {
+    return -int64(n), true
+  }
+  return int64(n), true
 }
 
+/* write n in decimal, as strconv.Uitoa64 without allocating */
+func writeUint(b *bytes.Buffer, n uint64) {
+  var digits [20]byte
+  i := len(digits)
+  for {
+    i--
+    digits[i] = byte('0' + n % 10)
+    if n /= 10; n == 0 {
+      break
+    }
+  }
+  b.Write(digits[i:])
+}
+
+func isNoreply(token []byte) bool {
+  return string(token) == "noreply"
+}
+
+/* set the key of a single key command for the slow log */
+func (s *Session) setKey(key string) {
+  s.oneKey[0] = key
+  s.keys = s.oneKey[:]
+}
+
+/* the most frequent replies, written without allocating */
+var (
+  crlf = []byte("\r\n")
+  endReply = []byte("END\r\n")
+  storedReply = []byte("STORED\r\n")
+  notStoredReply = []byte("NOT_STORED\r\n")
+  existsReply = []byte("EXISTS\r\n")
+  notFoundReply = []byte("NOT_FOUND\r\n")
+  deletedReply = []byte("DELETED\r\n")
+  touchedReply = []byte("TOUCHED\r\n")
+  missReply = []byte("EN\r\n")
+)
+
 ////////////////////////////// ERROR COMMANDS //////////////////////////////
 
 /* a function to reply errors to client that always returns false */
@@ -142,251 +414,748 @@ func Error(s *Session, errtype int, errdesc string) bool {
   return false
 }
 
-func (self *UnknownCommand) parse(line []string) bool{
+const maxKeyLength = 250
+
+/* whether keys are valid: up to 250 bytes, without control characters */
+func validKeys(keys ...string) bool {
+  for _, key := range keys {
+    if len(key) > maxKeyLength {
+      return false
+    }
+    for i := 0; i < len(key); i++ {
+      if key[i] < ' ' || key[i] == 0x7f {
+        return false
+      }
+    }
+  }
+  return true
+}
+
+/* discard a data block and its \r\n, so the next command is read in sync. bytes
+   must be at most maxDataBytes */
+func (s *Session) swallow(bytes uint64) {
+  io.CopyN(ioutil.Discard, s.bufreader, int64(bytes) + 2)
+}
+
+func (self *UnknownCommand) parse(line [][]byte) bool{
   return Error(self.session, InvalidCommand, "")
 }
 
 func (self *UnknownCommand) Exec() {
 }
 
-func (self *UninmplementedCommand) parse(line []string) bool {
+func (self *UninmplementedCommand) parse(line [][]byte) bool {
   return Error(self.session, ServerError, "Not Implemented")
 }
 
 func (self *UninmplementedCommand) Exec() {
 }
 
-///////////////////////////// TOUCH COMMAND //////////////////////////////
+///////////////////////////// WATCH COMMANDS //////////////////////////////
+
+func (self *WatchCommand) parse(tokens [][]byte) bool {
+  line := tokenStrings(tokens)
+  self.command = line[0]
+  self.keys = line[1:]
+  // without prefixes every key is streamed
+  self.stream = self.command == "watch_mutations"
+  if len(self.keys) == 0 && !self.stream {
+    return Error(self.session, ClientError, "Bad watch command: missing parameters")
+  }
+  if !validKeys(self.keys...) {
+    return Error(self.session, ClientError, "bad command line format")
+  }
+  return true
+}
+
+func (self *WatchCommand) Exec() {
+  if self.stream {
+    self.session.streamMutations(self.keys)
+    return
+  } else if self.command == "watch" {
+    watches.Watch(self.session, self.keys)
+  } else {
+    watches.Unwatch(self.session, self.keys)
+  }
+  self.session.conn.Write([]byte("OK\r\n"))
+}
+
+///////////////////////////// STATS COMMAND //////////////////////////////
+
+func (self *StatsCommand) parse(tokens [][]byte) bool {
+  line := tokenStrings(tokens)
+  self.args = line[1:]
+  if len(self.args) == 0 {
+    return Error(self.session, ServerError, "Not Implemented")
+  }
+  switch self.args[0] {
+  case "hotkeys":
+    if hotKeys == nil {
+      return Error(self.session, ServerError, "hot keys detection disabled")
+    }
+    return true
+  case "partitions":
+    if partitioner == nil {
+      return Error(self.session, ServerError, "partitions disabled")
+    }
+    return true
+  case "compression":
+    if compressor == nil {
+      return Error(self.session, ServerError, "compression disabled")
+    }
+    return true
+  case "cachedump":
+    self.limit = 100
+    if len(self.args) > 2 {
+      return Error(self.session, ClientError, "Bad stats command: expected stats cachedump [limit]")
+    } else if len(self.args) == 2 {
+      limit, err := strconv.Atoi(self.args[1])
+      if err != nil || limit <= 0 {
+        return Error(self.session, ClientError, "Bad stats command: bad limit")
+      }
+      self.limit = limit
+    }
+    return true
+  case "latency":
+    if len(self.args) > 2 || len(self.args) == 2 && self.args[1] != "reset" {
+      return Error(self.session, ClientError, "Bad stats command: expected stats latency [reset]")
+    }
+    return true
+  }
+  return Error(self.session, ClientError, "Bad stats command: unknown statistics group")
+}
+
+func (self *StatsCommand) Exec() {
+  var conn = self.session.conn
+  switch self.args[0] {
+  case "hotkeys":
+    for _, item := range hotKeys.Top() {
+      conn.Write([]byte(fmt.Sprintf("STAT %s %d\r\n", item.Key, item.Count)))
+    }
+  case "partitions":
+    size, old, migrated := partitioner.Size()
+    conn.Write([]byte(fmt.Sprintf("STAT partitions %d\r\n", size)))
+    if old > 0 {
+      conn.Write([]byte(fmt.Sprintf("STAT migrating_partitions %d\r\n", old)))
+      conn.Write([]byte(fmt.Sprintf("STAT migrated_partitions %d\r\n", migrated)))
+    }
+  case "latency":
+    if len(self.args) == 2 {
+      latencies.Reset()
+      conn.Write([]byte("RESET\r\n"))
+      return
+    }
+    latencies.writeStats(conn)
+  case "compression":
+    compressor.writeStats(conn)
+  case "cachedump":
+    conn.Write(self.cachedump())
+  }
+  conn.Write([]byte("END\r\n"))
+}
+
+/* largest cachedump, as memcached's */
+const cachedumpMaxBytes = 2 << 20
+
+/* the live items and their access, up to the limit or cachedumpMaxBytes. It's all
+   written once the iteration ends, as the storage is locked meanwhile */
+func (self *StatsCommand) cachedump() []byte {
+  var dump bytes.Buffer
+  count := 0
+  now := uint32(self.session.clock.Seconds())
+  self.session.storage.Iterate(func(key string, entry *StorageEntry) bool {
+    if entry.expired(now) {
+      return true
+    }
+    access := entry.accessInfo()
+    item := fmt.Sprintf("ITEM %s [%d b; %d s; %d created; %d accessed; %d fetches; %d fetched]\r\n",
+      key, entry.bytes, entry.exptime, access.created, access.accessed, access.fetches, access.fetched)
+    if dump.Len() + len(item) > cachedumpMaxBytes {
+      return false
+    }
+    dump.WriteString(item)
+    count++
+    return count < self.limit
+  })
+  return dump.Bytes()
+}
+
+///////////////////////////// REPARTITION COMMAND //////////////////////////////
+
+func (self *RepartitionCommand) parse(tokens [][]byte) bool {
+  line := tokenStrings(tokens)
+  if partitioner == nil {
+    return Error(self.session, ServerError, "partitions disabled")
+  } else if len(line) != 2 {
+    return Error(self.session, ClientError, "Bad repartition command: expected repartition <partitions>")
+  } else if size, err := strconv.Atoui(line[1]); err != nil || size == 0 {
+    return Error(self.session, ClientError, "Bad repartition command: bad partitions")
+  } else {
+    self.size = uint32(size)
+  }
+  return true
+}
+
+func (self *RepartitionCommand) Exec() {
+  if err := partitioner.Resize(self.size); err != nil {
+    Error(self.session, ServerError, err.String())
+  } else {
+    self.session.conn.Write([]byte("OK\r\n"))
+  }
+}
+
+///////////////////////////// CONFIG COMMAND //////////////////////////////
+
+func (self *ConfigCommand) parse(tokens [][]byte) bool {
+  line := tokenStrings(tokens)
+  if len(line) < 2 {
+    return Error(self.session, ClientError, "Bad config command: missing parameters")
+  }
+  self.subcommand = line[1]
+  self.args = line[2:]
+  switch self.subcommand {
+  case "get", "reload":
+    return true
+  case "set":
+    if len(self.args) != 2 {
+      return Error(self.session, ClientError, "Bad config command: expected config set <name> <value>")
+    }
+    return true
+  }
+  return Error(self.session, ClientError, "Bad config command: unknown subcommand")
+}
+
+func (self *ConfigCommand) Exec() {
+  var conn = self.session.conn
+  switch self.subcommand {
+  case "get":
+    names := self.args
+    if len(names) == 0 {
+      flag.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+    }
+    for _, name := range names {
+      if value, present := getSetting(name); present {
+        conn.Write([]byte(fmt.Sprintf("STAT %s %s\r\n", name, value)))
+      }
+    }
+    conn.Write([]byte("END\r\n"))
+  case "set":
+    if err := setSetting(self.args[0], self.args[1]); err != nil {
+      Error(self.session, ClientError, err.String())
+    } else {
+      logger.Info("Setting changed", "name", self.args[0], "value", self.args[1])
+      conn.Write([]byte("OK\r\n"))
+    }
+  case "reload":
+    if err := reloadConfig(); err != nil {
+      Error(self.session, ServerError, err.String())
+    } else {
+      conn.Write([]byte("OK\r\n"))
+    }
+  }
+}
+
+///////////////////////////// VERBOSITY COMMAND //////////////////////////////
+
+func (self *VerbosityCommand) parse(tokens [][]byte) bool {
+  line := tokenStrings(tokens)
+  if len(line) < 2 || len(line) > 3 || len(line) == 3 && line[2] != "noreply" {
+    return Error(self.session, ClientError, "Bad verbosity command: expected verbosity <level> [noreply]")
+  }
+  self.level = line[1]
+  self.noreply = len(line) == 3
+  return true
+}
+
+func (self *VerbosityCommand) Exec() {
+  if err := setSetting("verbosity", self.level); err != nil {
+    Error(self.session, ClientError, err.String())
+  } else {
+    logger.Info("Setting changed", "name", "verbosity", "value", self.level)
+    if !self.noreply {
+      self.session.conn.Write([]byte("OK\r\n"))
+    }
+  }
+}
+
+///////////////////////////// SLOWLOG COMMAND //////////////////////////////
+
+func (self *SlowlogCommand) parse(tokens [][]byte) bool {
+  line := tokenStrings(tokens)
+  if slowLog == nil {
+    return Error(self.session, ServerError, "slow log disabled")
+  } else if len(line) < 2 {
+    return Error(self.session, ClientError, "Bad slowlog command: missing parameters")
+  }
+  self.subcommand = line[1]
+  switch {
+  case self.subcommand == "reset" && len(line) == 2:
+    return true
+  case self.subcommand == "get" && len(line) == 2:
+    self.count = len(slowLog.entries)
+    return true
+  case self.subcommand == "get" && len(line) == 3:
+    if count, err := strconv.Atoi(line[2]); err != nil || count < 0 {
+      return Error(self.session, ClientError, "Bad slowlog command: bad count")
+    } else {
+      self.count = count
+    }
+    return true
+  }
+  return Error(self.session, ClientError, "Bad slowlog command: expected slowlog get [count] or slowlog reset")
+}
+
+func (self *SlowlogCommand) Exec() {
+  var conn = self.session.conn
+  if self.subcommand == "reset" {
+    slowLog.reset()
+    conn.Write([]byte("OK\r\n"))
+    return
+  }
+  for _, entry := range slowLog.last(self.count) {
+    conn.Write([]byte("SLOWLOG " + entry.String() + "\r\n"))
+  }
+  conn.Write([]byte("END\r\n"))
+}
+
+///////////////////////////// DEBUG COMMAND //////////////////////////////
+
+/* debug skew <seconds>, moves the server clock ahead (or behind, which only stops it
+   for a while) to test expirations without waiting */
+func (self *DebugCommand) parse(tokens [][]byte) bool {
+  line := tokenStrings(tokens)
+  if debugClock == nil {
+    return Error(self.session, ServerError, "debug commands disabled")
+  } else if len(line) != 3 || line[1] != "skew" {
+    return Error(self.session, ClientError, "Bad debug command: expected debug skew <seconds>")
+  } else if skew, err := strconv.Atoi64(line[2]); err != nil {
+    return Error(self.session, ClientError, "Bad debug command: bad seconds")
+  } else {
+    self.skew = skew
+  }
+  return true
+}
+
+func (self *DebugCommand) Exec() {
+  now := debugClock.Skew(self.skew)
+  logger.Info("Server clock skewed", "seconds", self.skew, "now", now)
+  self.session.conn.Write([]byte(fmt.Sprintf("OK %d\r\n", now)))
+}
 
-const secondsInMonth = 60*60*24*30
+///////////////////////////// CLUSTER COMMAND //////////////////////////////
 
-func (self *TouchCommand) parse(line []string) bool {
-  var exptime uint64
-  var err os.Error
+func (self *ClusterCommand) parse(tokens [][]byte) bool {
+  line := tokenStrings(tokens)
+  if cluster == nil {
+    return Error(self.session, ServerError, "clustering disabled")
+  } else if len(line) < 2 {
+    return Error(self.session, ClientError, "Bad cluster command: missing parameters")
+  }
+  self.subcommand = line[1]
+  self.args = line[2:]
+  switch self.subcommand {
+  case "members", "peer":
+    return true
+  case "join", "handoff":
+    if len(self.args) < 1 {
+      return Error(self.session, ClientError, "Bad cluster command: missing member address")
+    }
+    return true
+  }
+  return Error(self.session, ClientError, "Bad cluster command: unknown subcommand")
+}
+
+func (self *ClusterCommand) Exec() {
+  var conn = self.session.conn
+  switch self.subcommand {
+  case "members":
+    conn.Write([]byte("MEMBERS " + strings.Join(cluster.Members(), " ") + "\r\n"))
+  case "join":
+    cluster.AddMembers(self.args[:1])
+    conn.Write([]byte("MEMBERS " + strings.Join(cluster.Members(), " ") + "\r\n"))
+  case "peer":
+    self.session.peer = true
+    conn.Write([]byte("OK\r\n"))
+  case "handoff":
+    if migrated, err := cluster.Handoff(self.args[0]); err != nil {
+      Error(self.session, ServerError, "handoff failed: " + err.String())
+    } else {
+      conn.Write([]byte(fmt.Sprintf("MIGRATED %d\r\n", migrated)))
+    }
+  }
+}
+
+///////////////////////////// TOUCH COMMAND //////////////////////////////
+
+func (self *TouchCommand) parse(line [][]byte) bool {
+  var exptime int64
+  var ok bool
   if len(line) < 3 {
     return Error(self.session, ClientError, "Bad touch command: missing parameters")
-  } else if exptime, err = strconv.Atoui64(line[2]); err != nil {
+  } else if exptime, ok = parseExptime(line[2]); !ok {
     return Error(self.session, ClientError, "Bad touch command: bad expiration time")
   }
-  self.command = line[0]
-  self.key = line[1]
-  if exptime == 0 || exptime > secondsInMonth {
-    self.exptime = uint32(exptime)
-  } else {
-    self.exptime = uint32(time.Seconds()) + uint32(exptime);
-  }
-  if line[len(line)-1] == "noreply" {
-    self.noreply = true
+  self.key = string(line[1])
+  if !validKeys(self.key) {
+    return Error(self.session, ClientError, "bad command line format")
   }
+  self.exptime = expirationTime(exptime, self.session.clock.Seconds())
+  self.noreply = isNoreply(line[len(line)-1])
   return true
 }
 
 func (self *TouchCommand) Exec() {
-  logger.Printf("Touch: command: %s, key: %s, , exptime %d, noreply: %t",
-                self.command, self.key, self.exptime, self.noreply)
+  var storage = self.session.storage
+  var conn = self.session.conn
+  self.session.setKey(self.key)
+  if self.session.handingOff(self.key) {
+    return
+  }
+  if err, _, _ := storage.Touch(self.key, self.exptime) ; err != Ok && !self.noreply {
+    conn.Write(notFoundReply)
+  } else if err == Ok && !self.noreply {
+    conn.Write(touchedReply)
+  }
 }
 
 ///////////////////////////// DELETE COMMAND ////////////////////////////
 
-func (self *DeleteCommand) parse(line []string) bool {
+func (self *DeleteCommand) parse(line [][]byte) bool {
   if len(line) < 2 {
     return Error(self.session, ClientError, "Bad delete command: missing parameters")
   }
-  self.command = line[0]
-  self.key = line[1]
-  if line[len(line)-1] == "noreply" {
-    self.noreply = true
+  self.key = string(line[1])
+  if !validKeys(self.key) {
+    return Error(self.session, ClientError, "bad command line format")
   }
+  self.noreply = isNoreply(line[len(line)-1])
   return true
 }
 
 func (self *DeleteCommand) Exec() {
-//  logger.Printf("Delete: command: %s, key: %s, noreply: %t",
-//                self.command, self.key, self.noreply)
   var storage = self.session.storage
   var conn = self.session.conn
+  self.session.setKey(self.key)
+  if self.session.handingOff(self.key) {
+    return
+  }
   if err, _ := storage.Delete(self.key) ; err != Ok && !self.noreply {
-    conn.Write([]byte("NOT_FOUND\r\n"))
+    conn.Write(notFoundReply)
   } else if (err == Ok && !self.noreply) {
-    conn.Write([]byte("DELETED\r\n"))
+    conn.Write(deletedReply)
   }
 }
 
 ///////////////////////////// RETRIEVAL COMMANDS ////////////////////////////
 
-func (self *RetrievalCommand) parse(line []string) bool {
+func (self *RetrievalCommand) parse(line [][]byte) bool {
   if len(line) < 2 {
     return Error(self.session, ClientError, "Bad retrieval command: missing parameters")
   }
-  self.command = line[0]
-  self.keys = line[1:]
+  for _, key := range line[1:] {
+    self.keys = append(self.keys, string(key))
+  }
+  if !validKeys(self.keys...) {
+    return Error(self.session, ClientError, "bad command line format")
+  }
   return true
 }
 
 func (self *RetrievalCommand) Exec() {
-//  logger.Printf("Retrieval: command: %s, keys: %s",
-//                self.command, self.keys)
   var storage = self.session.storage
   var conn = self.session.conn
+  var header = &self.session.header
   showAll := self.command == "gets"
-  for i := 0; i < len(self.keys); i++ {
-    if err, entry := storage.Get(self.keys[i]); err == Ok {
+  self.session.keys = self.keys
+  entries := storage.GetMulti(self.keys)
+  for i, entry := range entries {
+    sampleHotKey(self.keys[i])
+    recordGet(entry != nil)
+    if entry != nil {
+      self.session.bytes += uint64(entry.bytes)
+      header.Reset()
+      header.WriteString("VALUE ")
+      header.WriteString(self.keys[i])
+      header.WriteByte(' ')
+      writeUint(header, uint64(entry.flags))
+      header.WriteByte(' ')
+      writeUint(header, uint64(entry.bytes))
       if showAll {
-        conn.Write([]byte(fmt.Sprintf("VALUE %s %d %d %d\r\n", self.keys[i], entry.flags, entry.bytes, entry.cas_unique)))
-      } else {
-        conn.Write([]byte(fmt.Sprintf("VALUE %s %d %d\r\n", self.keys[i], entry.flags, entry.bytes)))
+        header.WriteByte(' ')
+        writeUint(header, entry.cas_unique)
       }
+      header.Write(crlf)
+      conn.Write(header.Bytes())
       conn.Write(entry.content)
-      conn.Write([]byte("\r\n"))
+      conn.Write(crlf)
     }
   }
-  conn.Write([]byte("END\r\n"))
+  conn.Write(endReply)
+}
+
+///////////////////////////// META GET COMMAND ////////////////////////////
+
+/* mg <key> <flag>*, replying the flags asked for, as memcached does:
+   v the value, k the key, f the client flags, s the size, c the cas unique,
+   t the seconds left until it expires or -1, h whether it was fetched before since
+   it was written, l the seconds since it was accessed before, O an opaque token echoed */
+func (self *MetaGetCommand) parse(tokens [][]byte) bool {
+  line := tokenStrings(tokens)
+  if len(line) < 2 {
+    return Error(self.session, ClientError, "Bad mg command: missing parameters")
+  }
+  self.key, self.flags = line[1], line[2:]
+  if !validKeys(self.key) {
+    return Error(self.session, ClientError, "bad command line format")
+  }
+  for _, flag := range self.flags {
+    if len(flag) > 1 && flag[0] != 'O' || !strings.Contains("vkfsctlhO", flag[:1]) {
+      return Error(self.session, ClientError, "invalid flag")
+    }
+  }
+  return true
+}
+
+func (self *MetaGetCommand) Exec() {
+  var conn = self.session.conn
+  var header = &self.session.header
+  self.session.setKey(self.key)
+  err, entry := self.session.storage.Get(self.key)
+  sampleHotKey(self.key)
+  recordGet(err == Ok)
+  if err != Ok {
+    conn.Write(missReply)
+    return
+  }
+  value := false
+  for _, flag := range self.flags {
+    value = value || flag == "v"
+  }
+  access := entry.accessInfo()
+  now := uint32(self.session.clock.Seconds())
+  header.Reset()
+  if value {
+    self.session.bytes += uint64(entry.bytes)
+    header.WriteString("VA ")
+    writeUint(header, uint64(entry.bytes))
+  } else {
+    header.WriteString("HD")
+  }
+  for _, flag := range self.flags {
+    if flag == "v" {
+      continue
+    }
+    header.WriteByte(' ')
+    header.WriteString(flag)
+    switch flag[0] {
+    case 'k':
+      header.WriteString(self.key)
+    case 'f':
+      writeUint(header, uint64(entry.flags))
+    case 's':
+      writeUint(header, uint64(entry.bytes))
+    case 'c':
+      writeUint(header, entry.cas_unique)
+    case 't':
+      if entry.exptime == 0 {
+        header.WriteString("-1")
+      } else {
+        writeUint(header, uint64(secondsBetween(now, entry.exptime)))
+      }
+    case 'h':
+      // the fetch for this command is counted already
+      if access.fetched > 1 {
+        header.WriteByte('1')
+      } else {
+        header.WriteByte('0')
+      }
+    case 'l':
+      writeUint(header, uint64(secondsBetween(access.previous, now)))
+    }
+  }
+  header.Write(crlf)
+  conn.Write(header.Bytes())
+  if value {
+    conn.Write(entry.content)
+    conn.Write(crlf)
+  }
+}
+
+/* seconds from start to end, or 0 if end comes first */
+func secondsBetween(start uint32, end uint32) uint32 {
+  if end < start {
+    return 0
+  }
+  return end - start
 }
 
 ///////////////////////////// STORAGE COMMANDS /////////////////////////////
 
 /* parse a storage command parameters and read the related data
    returns a flag indicating sucesss */
-func (self *StorageCommand) parse(line []string) bool {
-  var flags, exptime, bytes, casuniq uint64
-  var err os.Error
+func (self *StorageCommand) parse(line [][]byte) bool {
   if len(line) < 5 {
     return Error(self.session, ClientError, "Bad storage command: missing parameters")
-  } else if flags, err = strconv.Atoui64(line[2]); err != nil {
+  }
+  bytes, ok := parseUint(line[4])
+  if !ok {
+    return Error(self.session, ClientError, "Bad storage command: bad byte-length")
+  } else if bytes > maxDataBytes {
+    // no data block that large could follow, so none is swallowed
+    return Error(self.session, ClientError, "bad data chunk")
+  } else if !self.parseParameters(line, bytes) {
+    // the data block follows anyway
+    self.session.swallow(bytes)
+    return false
+  }
+  return self.readData()
+}
+
+/* parse the storage command parameters but the byte-length, returns a flag indicating success */
+func (self *StorageCommand) parseParameters(line [][]byte, bytes uint64) bool {
+  var flags, casuniq uint64
+  var exptime int64
+  var ok bool
+  self.key = string(line[1])
+  if bytes > maxItemBytes() {
+    return Error(self.session, ServerError, "object too large for cache")
+  } else if !validKeys(self.key) {
+    return Error(self.session, ClientError, "bad command line format")
+  } else if flags, ok = parseUint(line[2]); !ok {
     return Error(self.session, ClientError, "Bad storage command: bad flags")
-  } else if exptime, err = strconv.Atoui64(line[3]); err != nil {
+  } else if exptime, ok = parseExptime(line[3]); !ok {
     return Error(self.session, ClientError, "Bad storage command: bad expiration time")
-  } else if bytes, err = strconv.Atoui64(line[4]); err != nil {
-    return Error(self.session, ClientError, "Bad storage command: bad byte-length")
-  } else if line[0] == "cas" {
-    if casuniq, err = strconv.Atoui64(line[5]); err != nil {
+  } else if self.command == "cas" {
+    if len(line) < 6 {
+      return Error(self.session, ClientError, "Bad storage command: missing parameters")
+    } else if casuniq, ok = parseUint(line[5]); !ok {
       return Error(self.session, ClientError, "Bad storage command: bad cas value")
     }
   }
-  self.command = line[0]
-  self.key = line[1]
   self.flags = uint32(flags)
-  if exptime == 0 || exptime > secondsInMonth {
-    self.exptime = uint32(exptime)
-  } else {
-    self.exptime = uint32(time.Seconds()) + uint32(exptime);
-  }
+  self.exptime = expirationTime(exptime, self.session.clock.Seconds())
   self.bytes = uint32(bytes)
   self.cas_unique = casuniq
-  if line[len(line)-1] == "noreply" {
-    self.noreply = true
-  }
-  return self.readData()
+  self.noreply = isNoreply(line[len(line)-1])
+  return true
 }
 
-/* read the data for a storage command and return a flag indicating success */
+/* read the data for a storage command and return a flag indicating success. The
+   data is kept by the storage, so it's the only allocation made reading it */
 func (self *StorageCommand) readData() bool {
-  if self.bytes <= 0 {
-    return Error(self.session, ClientError, "Bad storage operation: trying to read 0 bytes")
-  } else {
-    self.data = make([]byte, self.bytes + 2) // \r\n is always present at the end
-  }
   var reader = self.session.bufreader
-  // read all the data
-  for offset := 0; offset < int(self.bytes); {
-    if nread, err := reader.Read(self.data[offset:]); err != nil {
-      return Error(self.session, ServerError, "Failed to read data")
-    } else {
-      offset += nread
+  self.data = make([]byte, self.bytes)
+  if _, err := io.ReadFull(reader, self.data); err != nil {
+    return Error(self.session, ServerError, "Failed to read data")
+  }
+  // \r\n is always present at the end
+  cr, err := reader.ReadByte()
+  if err == nil {
+    var lf byte
+    if lf, err = reader.ReadByte(); err == nil && (cr != '\r' || lf != '\n') {
+      return Error(self.session, ClientError, "Bad storage operation: bad data chunk")
     }
   }
-  if string(self.data[len(self.data)-2:]) != "\r\n" {
-    return Error(self.session, ClientError, "Bad storage operation: bad data chunk")
+  if err != nil {
+    return Error(self.session, ServerError, "Failed to read data")
   }
-  self.data = self.data[:len(self.data)-2] // strip \n\r
   return true
 }
 
 func (self *StorageCommand) Exec() {
-/*  logger.Printf("Storage: key: %s, flags: %d, exptime: %d, " +
-                "bytes: %d, cas: %d, noreply: %t, content: %s\n",
-                self.key, self.flags, self.exptime, self.bytes,
-                self.cas_unique, self.noreply, string(self.data))
-*/
   var storage = self.session.storage
   var conn = self.session.conn
+  sampleHotKey(self.key)
+  self.session.setKey(self.key)
+  self.session.bytes = uint64(self.bytes)
+  if memoryExhausted() {
+    Error(self.session, ServerError, "out of memory storing object")
+    return
+  } else if self.session.handingOff(self.key) {
+    return
+  }
 
   switch self.command {
 
   case "set":
     storage.Set(self.key, self.flags, self.exptime, self.bytes, self.data)
     if !self.noreply {
-      conn.Write([]byte("STORED\r\n"))
+      conn.Write(storedReply)
     }
     return
   case "add":
     if err, _ := storage.Add(self.key, self.flags, self.exptime, self.bytes, self.data); err != Ok && !self.noreply {
-      conn.Write([]byte("NOT_STORED\r\n"))
+      conn.Write(notStoredReply)
     } else if err == Ok && !self.noreply {
-      conn.Write([]byte("STORED\r\n"))
+      conn.Write(storedReply)
     }
   case "replace":
     if err, _, _ := storage.Replace(self.key, self.flags, self.exptime, self.bytes, self.data) ; err != Ok && !self.noreply {
-      conn.Write([]byte("NOT_STORED\r\n"))
+      conn.Write(notStoredReply)
     } else if err == Ok && !self.noreply {
-      conn.Write([]byte("STORED\r\n"))
+      conn.Write(storedReply)
     }
   case "append":
-    if err, _, _ := storage.Append(self.key, self.bytes, self.data) ; err != Ok && !self.noreply {
-      conn.Write([]byte("NOT_STORED\r\n"))
+    if err, _, _ := storage.Append(self.key, self.bytes, self.data) ; err == TooLarge {
+      Error(self.session, ServerError, "out of memory storing object")
+    } else if err != Ok && !self.noreply {
+      conn.Write(notStoredReply)
     } else if err == Ok && !self.noreply {
-      conn.Write([]byte("STORED\r\n"))
+      conn.Write(storedReply)
     }
   case "prepend":
-    if err, _, _ := storage.Prepend(self.key, self.bytes, self.data) ; err != Ok && !self.noreply {
-      conn.Write([]byte("NOT_STORED\r\n"))
+    if err, _, _ := storage.Prepend(self.key, self.bytes, self.data) ; err == TooLarge {
+      Error(self.session, ServerError, "out of memory storing object")
+    } else if err != Ok && !self.noreply {
+      conn.Write(notStoredReply)
     } else if err == Ok && !self.noreply {
-      conn.Write([]byte("STORED\r\n"))
+      conn.Write(storedReply)
     }
   case "cas":
     if err, prev, _ := storage.Cas(self.key, self.flags, self.exptime, self.bytes, self.cas_unique, self.data) ; err != Ok && !self.noreply {
       if prev != nil {
-        conn.Write([]byte("EXISTS\r\n"))
+        conn.Write(existsReply)
       } else {
-        conn.Write([]byte("NOT_STORED\r\n"))
+        conn.Write(notFoundReply)
       }
     } else if err == Ok && !self.noreply {
-      conn.Write([]byte("STORED\r\n"))
+      conn.Write(storedReply)
     }
   }
 }
 
 ///////////////////////////// INCR/DECR COMMANDS /////////////////////////////
 
-func (self *IncrCommand) parse(line []string) bool {
-  var err os.Error
+func (self *IncrCommand) parse(line [][]byte) bool {
+  var ok bool
   if len(line) < 3 {
     return Error(self.session, ClientError, "Bad incr/decr command: missing parameters")
-  } else if self.value, err = strconv.Atoui64(line[2]); err != nil {
+  } else if self.value, ok = parseUint(line[2]); !ok {
     return Error(self.session, ClientError, "Bad incr/decr command: bad value")
   }
-  self.incr = (line[0] == "incr")
-  self.key = line[1]
-
-  if len(line) == 4 && line[3] == "noreply" {
-    self.noreply = true
-  } else {
-    self.noreply = false
+  self.key = string(line[1])
+  if !validKeys(self.key) {
+    return Error(self.session, ClientError, "bad command line format")
   }
+  self.noreply = len(line) == 4 && isNoreply(line[3])
   return true
 }
 
 func (self *IncrCommand) Exec() {
   var storage = self.session.storage
   var conn = self.session.conn
+  self.session.setKey(self.key)
+  if self.session.handingOff(self.key) {
+    return
+  }
   err, _, current := storage.Incr(self.key, self.value, self.incr)
   if self.noreply { return }
   if err == Ok {
     conn.Write(current.content)
-    conn.Write([]byte("\r\n"))
+    conn.Write(crlf)
   } else if err == KeyNotFound {
   //not reaching here
-    conn.Write([]byte("NOT_FOUND\r\n"))
+    conn.Write(notFoundReply)
   } else if err == IllegalParameter {
     conn.Write([]byte(fmt.Sprintf("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")))
   }
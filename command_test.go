@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Endless stream repeating the same requests
+type repeatReader struct {
+	data   []byte
+	offset int
+}
+
+func (self *repeatReader) Read(b []byte) (int, os.Error) {
+	n := copy(b, self.data[self.offset:])
+	self.offset = (self.offset + n) % len(self.data)
+	return n, nil
+}
+
+func newParsingSession(requests string) *Session {
+	return &Session{bufreader: bufio.NewReader(&repeatReader{data: []byte(requests)}), clock: serverClock}
+}
+
+func TestReadTokens(t *testing.T) {
+	longLine := "get" + strings.Repeat(" key", 2000)
+	lines := []struct {
+		line   string
+		tokens []string
+	}{
+		{"get a b\r\n", []string{"get", "a", "b"}},
+		{"  set\ta 0  0 1 \r\n", []string{"set", "a", "0", "0", "1"}},
+		{"\r\n", []string{}},
+		{"get c\n", []string{"get", "c"}},
+		{longLine + "\r\n", strings.Fields(longLine)},
+		{"get" + strings.Repeat(" key", maxLineLength/4) + "\r\n", []string{}},
+		{"get d", []string{"get", "d"}},
+	}
+	input := ""
+	for _, l := range lines {
+		input += l.line
+	}
+	s := &Session{bufreader: bufio.NewReader(strings.NewReader(input))}
+	for _, l := range lines {
+		tokens, ok := s.readTokens()
+		if !ok {
+			t.Fatalf("%q: unexpected end", l.line)
+		}
+		if got := tokenStrings(tokens); strings.Join(got, "|") != strings.Join(l.tokens, "|") || len(got) != len(l.tokens) {
+			t.Errorf("%q: expected %q, got %q", abbreviate(l.line), l.tokens, got)
+		}
+	}
+	if _, ok := s.readTokens(); ok {
+		t.Error("Expected the end of the input")
+	}
+}
+
+func TestParseUint(t *testing.T) {
+	numbers := []struct {
+		token string
+		value uint64
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"42", 42, true},
+		{"18446744073709551615", 1<<64 - 1, true},
+		{"18446744073709551616", 0, false},
+		{"99999999999999999999", 0, false},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"1x", 0, false},
+	}
+	for _, n := range numbers {
+		if value, ok := parseUint([]byte(n.token)); value != n.value || ok != n.ok {
+			t.Errorf("%q: expected %d %v, got %d %v", n.token, n.value, n.ok, value, ok)
+		}
+	}
+}
+
+func TestReusedCommandsAreReset(t *testing.T) {
+	s := newParsingSession("set a 1 0 1 noreply\r\nx\r\nset b 0 0 1\r\ny\r\ngets a b\r\nget c\r\n")
+	parse := func() Command {
+		line, _ := s.readTokens()
+		cmd, _ := cmdSelect(line[0], s)
+		if !cmd.parse(line) {
+			t.Fatalf("Unable to parse %q", tokenStrings(line))
+		}
+		return cmd
+	}
+	parse()
+	if set := parse().(*StorageCommand); set.noreply || set.flags != 0 || set.key != "b" || string(set.data) != "y" {
+		t.Errorf("Second set kept the previous parameters: %+v", *set)
+	}
+	parse()
+	if get := parse().(*RetrievalCommand); get.command != "get" || len(get.keys) != 1 || get.keys[0] != "c" {
+		t.Errorf("Second get kept the previous parameters: %+v", *get)
+	}
+}
+
+// Parse the requests over and over. In steady state only the keys and values are
+// allocated, as reported by -benchmem.
+func benchmarkParse(b *testing.B, requests string) {
+	s := newParsingSession(requests)
+	for i := 0; i < b.N; i++ {
+		line, _ := s.readTokens()
+		cmd, _ := cmdSelect(line[0], s)
+		cmd.parse(line)
+	}
+}
+
+func BenchmarkParseGet(b *testing.B) {
+	benchmarkParse(b, "get some:key\r\n")
+}
+
+func BenchmarkParseMultiGet(b *testing.B) {
+	benchmarkParse(b, "gets key:1 key:2 key:3 key:4 key:5 key:6 key:7 key:8 key:9 key:10\r\n")
+}
+
+func BenchmarkParseSet(b *testing.B) {
+	benchmarkParse(b, "set some:key 0 0 10\r\n0123456789\r\n")
+}
+
+// Run a request over and over through an in-process server, replies included. Unlike
+// the tests, the client reads without a timeout so that it allocates nothing. setup is
+// sent first, it must not be replied.
+func benchmarkProtocol(b *testing.B, setup string, request string, response string) {
+	b.StopTimer()
+	client := newTestClient(b, startTestServer(b))
+	defer client.Close()
+	client.send(setup)
+	sent, got := []byte(request), make([]byte, len(response))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		client.conn.Write(sent)
+		if _, err := io.ReadFull(client.reader, got); err != nil || string(got) != response {
+			b.Fatalf("Expected %q, got %q", response, got)
+		}
+	}
+}
+
+func BenchmarkProtocolGet(b *testing.B) {
+	benchmarkProtocol(b, "set some:key 0 0 10 noreply\r\n0123456789\r\n", "get some:key\r\n",
+		"VALUE some:key 0 10\r\n0123456789\r\nEND\r\n")
+}
+
+func BenchmarkProtocolSet(b *testing.B) {
+	benchmarkProtocol(b, "", "set some:key 0 0 10\r\n0123456789\r\n", "STORED\r\n")
+}
+
+func TestCachedumpIsCapped(t *testing.T) {
+	storage := newMapCacheStorage(serverClock)
+	prefix := strings.Repeat("k", 200)
+	for i := 0; i < 10000; i++ {
+		storage.Set(prefix+strconv.Itoa(i), 0, 0, 1, []byte("v"))
+	}
+	s := &Session{storage: storage, clock: serverClock}
+	stats := &StatsCommand{session: s, args: []string{"cachedump"}, limit: 20000}
+	if dump := stats.cachedump(); len(dump) > cachedumpMaxBytes || len(dump) < cachedumpMaxBytes-300 {
+		t.Errorf("Expected up to %d bytes, dumped %d", cachedumpMaxBytes, len(dump))
+	}
+	stats.limit = 3
+	if dump := string(stats.cachedump()); strings.Count(dump, "ITEM ") != 3 {
+		t.Errorf("Expected 3 items, dumped %q", dump)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"lz"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// how a value is stored, given by its first byte
+const (
+	rawValue        = 0 // the value follows as it is
+	compressedValue = 1 // the value length follows as 4 big endian bytes, then the value compressed by lz
+)
+
+const (
+	// idle compressors kept for reuse, further ones are dropped
+	idleCompressors = 64
+	// largest buffer kept by an idle compressor
+	compressorBufferBytes = 64 << 10
+)
+
+// value compression, nil when disabled
+var compressor *CompressingStorage
+
+// Storage compressing the values of at least threshold bytes with lz, when that
+// makes them smaller. Every value is stored after a byte telling how, so the flags are
+// left to the clients, who always get back the bytes they stored. Appending, prepending
+// and incrementing need the whole value, so they're done as a peek and a rewrite,
+// retried while the value changes in between. The storage below must be a
+// valueRewriter.
+type CompressingStorage struct {
+	CacheStorage
+	threshold       int
+	compressors     chan *valueCompressor // idle ones, reused by the next values
+	compressed      uint64                // values stored compressed
+	originalBytes   uint64                // size of the values stored compressed
+	compressedBytes uint64                // and once compressed
+}
+
+// Storage whose values can be rewritten by the server, as a cas that leaves the rest
+// of the item as it is.
+type valueRewriter interface {
+	// Replace the value of key, but only if it didn't change since fetched with
+	// cas_unique. Fails like Cas.
+	Rewrite(key string, bytes uint32, cas_unique uint64, content []byte) (err ErrorCode, previous *StorageEntry, result *StorageEntry)
+}
+
+// A compressor along with the buffer it compresses into, so that a stored value is
+// allocated at its exact size
+type valueCompressor struct {
+	lz.Compressor
+	buffer []byte
+}
+
+func newCompressingStorage(storage CacheStorage, threshold int) *CompressingStorage {
+	return &CompressingStorage{CacheStorage: storage, threshold: threshold,
+		compressors: make(chan *valueCompressor, idleCompressors)}
+}
+
+// stored form of a value
+func (self *CompressingStorage) encode(content []byte) []byte {
+	if len(content) >= self.threshold {
+		length := len(content)
+		var compressor *valueCompressor
+		select {
+		case compressor = <-self.compressors:
+		default:
+			compressor = new(valueCompressor)
+		}
+		header := append(compressor.buffer[:0], compressedValue, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+		compressor.buffer = compressor.Compress(header, content)
+		var stored []byte
+		if len(compressor.buffer) <= length {
+			stored = make([]byte, len(compressor.buffer))
+			copy(stored, compressor.buffer)
+		}
+		if cap(compressor.buffer) > compressorBufferBytes {
+			compressor.buffer = nil
+		}
+		select {
+		case self.compressors <- compressor:
+		default:
+		}
+		if stored != nil {
+			return stored
+		}
+	}
+	stored := make([]byte, len(content)+1)
+	stored[0] = rawValue
+	copy(stored[1:], content)
+	return stored
+}
+
+// Count a value once stored in its stored form
+func (self *CompressingStorage) count(content []byte, stored []byte) {
+	if stored[0] == compressedValue {
+		atomic.AddUint64(&self.compressed, 1)
+		atomic.AddUint64(&self.originalBytes, uint64(len(content)))
+		atomic.AddUint64(&self.compressedBytes, uint64(len(stored)))
+	}
+}
+
+// stored form that doesn't hold a value
+var errCorruptValue = os.NewError("corrupt stored value")
+
+// value of a stored form, fails when the stored form is corrupt
+func decodeValue(stored []byte) ([]byte, os.Error) {
+	if len(stored) == 0 {
+		return stored, nil
+	} else if stored[0] == rawValue {
+		return stored[1:], nil
+	} else if stored[0] != compressedValue || len(stored) < 5 {
+		return nil, errCorruptValue
+	}
+	length := int(stored[1])<<24 | int(stored[2])<<16 | int(stored[3])<<8 | int(stored[4])
+	content, err := lz.Decompress(make([]byte, 0, length), stored[5:])
+	if err != nil {
+		return nil, err
+	} else if len(content) != length {
+		return nil, errCorruptValue
+	}
+	return content, nil
+}
+
+// stored entry as the clients see it, nil when nil or when its value can't be
+// decoded, so that it's served as a miss
+func decodeEntry(entry *StorageEntry) *StorageEntry {
+	if entry == nil {
+		return nil
+	}
+	content, err := decodeValue(entry.content)
+	if err != nil {
+		logger.Error("Unable to decode a value", "err", err)
+		return nil
+	}
+	return withContent(entry, content)
+}
+
+// entry replaced, deleted or touched as the clients see it, nil stays nil. One whose
+// value can't be decoded is kept without it, as the rest of the entry still tells
+// what changed.
+func previousEntry(entry *StorageEntry) *StorageEntry {
+	if entry == nil {
+		return nil
+	} else if decoded := decodeEntry(entry); decoded != nil {
+		return decoded
+	}
+	return withContent(entry, nil)
+}
+
+// stored entry with the content it was stored for
+func withContent(entry *StorageEntry, content []byte) *StorageEntry {
+	if entry == nil {
+		return nil
+	}
+	return &StorageEntry{entry.exptime, entry.flags, uint32(len(content)), entry.cas_unique, content, entry.accessInfo()}
+}
+
+func (self *CompressingStorage) Set(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (previous *StorageEntry, result *StorageEntry) {
+	stored := self.encode(content)
+	previous, result = self.CacheStorage.Set(key, flags, exptime, uint32(len(stored)), stored)
+	self.count(content, stored)
+	return previousEntry(previous), withContent(result, content)
+}
+
+func (self *CompressingStorage) Add(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (err ErrorCode, result *StorageEntry) {
+	stored := self.encode(content)
+	err, result = self.CacheStorage.Add(key, flags, exptime, uint32(len(stored)), stored)
+	if err == Ok {
+		self.count(content, stored)
+	}
+	return err, withContent(result, content)
+}
+
+func (self *CompressingStorage) Replace(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (err ErrorCode, previous *StorageEntry, result *StorageEntry) {
+	stored := self.encode(content)
+	err, previous, result = self.CacheStorage.Replace(key, flags, exptime, uint32(len(stored)), stored)
+	if err == Ok {
+		self.count(content, stored)
+	}
+	return err, previousEntry(previous), withContent(result, content)
+}
+
+func (self *CompressingStorage) Cas(key string, flags uint32, exptime uint32, bytes uint32, cas_unique uint64, content []byte) (err ErrorCode, previous *StorageEntry, result *StorageEntry) {
+	stored := self.encode(content)
+	err, previous, result = self.CacheStorage.Cas(key, flags, exptime, uint32(len(stored)), cas_unique, stored)
+	if err == Ok {
+		self.count(content, stored)
+	}
+	return err, previousEntry(previous), withContent(result, content)
+}
+
+func (self *CompressingStorage) Append(key string, bytes uint32, content []byte) (err ErrorCode, previous *StorageEntry, result *StorageEntry) {
+	return self.update(key, func(current []byte) ([]byte, ErrorCode) {
+		if outgrows(current, content) {
+			return nil, TooLarge
+		}
+		updated := make([]byte, 0, len(current)+len(content))
+		return append(append(updated, current...), content...), Ok
+	})
+}
+
+func (self *CompressingStorage) Prepend(key string, bytes uint32, content []byte) (err ErrorCode, previous *StorageEntry, result *StorageEntry) {
+	return self.update(key, func(current []byte) ([]byte, ErrorCode) {
+		if outgrows(current, content) {
+			return nil, TooLarge
+		}
+		updated := make([]byte, 0, len(current)+len(content))
+		return append(append(updated, content...), current...), Ok
+	})
+}
+
+func (self *CompressingStorage) Incr(key string, value uint64, incr bool) (err ErrorCode, previous *StorageEntry, result *StorageEntry) {
+	return self.update(key, func(current []byte) ([]byte, ErrorCode) {
+		number, err := strconv.Atoui64(string(current))
+		if err != nil {
+			return nil, IllegalParameter
+		}
+		if incr {
+			number += value
+		} else if value > number {
+			number = 0
+		} else {
+			number -= value
+		}
+		return []byte(strconv.Uitoa64(number)), Ok
+	})
+}
+
+// Replace the value of key by the one computed from it, with a rewrite retried until
+// the key doesn't change meanwhile
+func (self *CompressingStorage) update(key string, compute func(current []byte) ([]byte, ErrorCode)) (ErrorCode, *StorageEntry, *StorageEntry) {
+	for {
+		err, entry := self.CacheStorage.Peek(key)
+		if err != Ok {
+			return err, nil, nil
+		}
+		previous := decodeEntry(entry)
+		if previous == nil {
+			return KeyNotFound, nil, nil
+		}
+		content, err := compute(previous.content)
+		if err != Ok {
+			return err, nil, nil
+		}
+		stored := self.encode(content)
+		err, _, result := self.CacheStorage.(valueRewriter).Rewrite(key, uint32(len(stored)), entry.cas_unique, stored)
+		if err == Ok {
+			self.count(content, stored)
+			return Ok, previous, withContent(result, content)
+		} else if err == KeyNotFound {
+			return err, nil, nil
+		}
+	}
+	return KeyNotFound, nil, nil
+}
+
+func (self *CompressingStorage) Get(key string) (err ErrorCode, result *StorageEntry) {
+	err, result = self.CacheStorage.Get(key)
+	if result = decodeEntry(result); err == Ok && result == nil {
+		err = KeyNotFound
+	}
+	return err, result
+}
+
+func (self *CompressingStorage) Peek(key string) (err ErrorCode, result *StorageEntry) {
+	err, result = self.CacheStorage.Peek(key)
+	if result = decodeEntry(result); err == Ok && result == nil {
+		err = KeyNotFound
+	}
+	return err, result
+}
+
+func (self *CompressingStorage) GetMulti(keys []string) []*StorageEntry {
+	entries := self.CacheStorage.GetMulti(keys)
+	for i, entry := range entries {
+		entries[i] = decodeEntry(entry)
+	}
+	return entries
+}
+
+func (self *CompressingStorage) Delete(key string) (err ErrorCode, deleted *StorageEntry) {
+	err, deleted = self.CacheStorage.Delete(key)
+	return err, previousEntry(deleted)
+}
+
+func (self *CompressingStorage) CasDelete(key string, cas_unique uint64) (err ErrorCode, deleted *StorageEntry) {
+	err, deleted = self.CacheStorage.CasDelete(key, cas_unique)
+	return err, previousEntry(deleted)
+}
+
+func (self *CompressingStorage) Touch(key string, exptime uint32) (err ErrorCode, previous *StorageEntry, result *StorageEntry) {
+	err, previous, result = self.CacheStorage.Touch(key, exptime)
+	if err != Ok {
+		return err, nil, nil
+	}
+	previous = previousEntry(previous)
+	return err, previous, withContent(result, previous.content)
+}
+
+func (self *CompressingStorage) Iterate(visitor EntryVisitor) {
+	self.CacheStorage.Iterate(func(key string, entry *StorageEntry) bool {
+		if entry = decodeEntry(entry); entry == nil {
+			return true
+		}
+		return visitor(key, entry)
+	})
+}
+
+// Write the compression stats, counting every value stored since the server started
+func (self *CompressingStorage) writeStats(w io.Writer) {
+	original, compressed := atomic.AddUint64(&self.originalBytes, 0), atomic.AddUint64(&self.compressedBytes, 0)
+	ratio := 1.0
+	if compressed > 0 {
+		ratio = float64(original) / float64(compressed)
+	}
+	fmt.Fprintf(w, "STAT compression_threshold %d\r\n", self.threshold)
+	fmt.Fprintf(w, "STAT compressed_values %d\r\n", atomic.AddUint64(&self.compressed, 0))
+	fmt.Fprintf(w, "STAT compressed_original_bytes %d\r\n", original)
+	fmt.Fprintf(w, "STAT compressed_bytes %d\r\n", compressed)
+	fmt.Fprintf(w, "STAT compression_ratio %.2f\r\n", ratio)
+}
+
+// Write the compression counters in the Prometheus text format
+func (self *CompressingStorage) expose(w io.Writer) {
+	header(w, "gocached_compressed_values_total", "counter", "Values stored compressed.")
+	fmt.Fprintf(w, "gocached_compressed_values_total %d\n", atomic.AddUint64(&self.compressed, 0))
+	header(w, "gocached_compressed_original_bytes_total", "counter", "Size of the values stored compressed, before compressing.")
+	fmt.Fprintf(w, "gocached_compressed_original_bytes_total %d\n", atomic.AddUint64(&self.originalBytes, 0))
+	header(w, "gocached_compressed_bytes_total", "counter", "Size of the values stored compressed, once compressed.")
+	fmt.Fprintf(w, "gocached_compressed_bytes_total %d\n", atomic.AddUint64(&self.compressedBytes, 0))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompressionIsTransparent(t *testing.T) {
+	base := newMapCacheStorage(serverClock)
+	storage := newCompressingStorage(base, 64)
+	json := []byte(strings.Repeat(`{"id": 1, "name": "some name", "tags": ["a", "b"]}`, 20))
+	values := map[string][]byte{"json": json, "small": []byte("small"), "random": []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ+/")}
+	for key, value := range values {
+		storage.Set(key, 0xffffffff, 0, uint32(len(value)), value)
+		if _, entry := storage.Get(key); entry == nil || !bytes.Equal(entry.content, value) || entry.bytes != uint32(len(value)) || entry.flags != 0xffffffff {
+			t.Errorf("%s: got back %+v", key, entry)
+		}
+	}
+
+	_, stored := base.Get("json")
+	if stored.content[0] != compressedValue || int(stored.bytes) > len(json)/5 {
+		t.Errorf("Expected json compressed, stored %d bytes out of %d", stored.bytes, len(json))
+	}
+	for _, key := range []string{"small", "random"} {
+		if _, stored := base.Get(key); stored.content[0] != rawValue || int(stored.bytes) != len(values[key])+1 {
+			t.Errorf("Expected %s stored raw, stored %d bytes", key, stored.bytes)
+		}
+	}
+	// values not stored aren't counted
+	storage.Add("json", 0, 0, uint32(len(json)), json)
+	storage.Replace("missing", 0, 0, uint32(len(json)), json)
+	if storage.compressed != 1 || storage.originalBytes != uint64(len(json)) || storage.compressedBytes != uint64(stored.bytes) {
+		t.Errorf("Bad compression counters %d %d %d", storage.compressed, storage.originalBytes, storage.compressedBytes)
+	}
+
+	storage.Append("json", 3, []byte("end"))
+	storage.Prepend("json", 5, []byte("start"))
+	if _, entry := storage.Get("json"); string(entry.content) != "start"+string(json)+"end" {
+		t.Error("Append and prepend didn't keep the value")
+	}
+	storage.Set("number", 0, 0, 65, []byte(strings.Repeat("0", 64)+"1"))
+	if err, _, result := storage.Incr("number", 41, true); err != Ok || string(result.content) != "42" {
+		t.Errorf("Incr of a compressed number, got %v %+v", err, result)
+	}
+}
+
+func TestCompressedUpdatesKeepTheAccess(t *testing.T) {
+	base := newMapCacheStorage(serverClock)
+	storage := newCompressingStorage(base, 4)
+	storage.Set("key", 0, 0, 2, []byte("40"))
+	storage.Get("key")
+	storage.Get("key")
+	storage.Append("key", 5, []byte("00000"))
+	storage.Incr("key", 2, true)
+	_, entry := base.Peek("key")
+	if access := entry.accessInfo(); access.fetches != 2 || access.fetched != 0 {
+		t.Errorf("Expected the 2 fetches kept and none since written, got %+v", access)
+	}
+	if _, entry := storage.Peek("key"); string(entry.content) != "4000002" || entry.accessInfo().fetches != 2 {
+		t.Errorf("Peek got %+v", entry)
+	}
+}
+
+func TestCorruptValuesAreMisses(t *testing.T) {
+	base := newMapCacheStorage(serverClock)
+	storage := newCompressingStorage(base, 4)
+	value := []byte(strings.Repeat("corrupt ", 20))
+	storage.Set("key", 0, 0, uint32(len(value)), value)
+	_, stored := base.Peek("key")
+	for _, corrupt := range [][]byte{stored.content[:len(stored.content)-2], stored.content[:3], {2, 'a'}} {
+		base.Set("key", 0, 0, uint32(len(corrupt)), corrupt)
+		if err, entry := storage.Get("key"); err != KeyNotFound || entry != nil {
+			t.Errorf("Get of %v got %v %+v", corrupt, err, entry)
+		}
+		if entries := storage.GetMulti([]string{"key"}); entries[0] != nil {
+			t.Errorf("GetMulti of %v got %+v", corrupt, entries[0])
+		}
+		if err, _, _ := storage.Append("key", 1, []byte("a")); err != KeyNotFound {
+			t.Errorf("Append to %v got %v", corrupt, err)
+		}
+	}
+	if err, deleted := storage.Delete("key"); err != Ok || deleted == nil {
+		t.Errorf("Delete got %v %+v", err, deleted)
+	}
+}
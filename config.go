@@ -0,0 +1,264 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Every command line flag can also be set from a config file, with one `name = value`
+// line per flag (a flat TOML file: strings may be quoted, # starts a comment). Flags
+// given on the command line win over the file. The settings below may also change
+// while running, through `config set` or by reloading the file on SIGHUP; any other
+// change in the file needs a restart. Settings read once, outside the flag, have a
+// function applying them after every change.
+var runtimeSettings = map[string]func(){
+	"expiring-interval": nil,
+	"hotkeys-interval":  nil,
+	"hotkeys-log":       nil,
+	"max-connections":   nil,
+	"max-item-size":     nil,
+	"max-memory":        nil,
+	"slowlog-bytes":     nil,
+	"slowlog-latency":   nil,
+	"verbosity":         applyVerbosity,
+}
+
+// guards the flag values of the runtime settings
+var settingsLock sync.RWMutex
+
+// config file path, empty when none was given
+var configPath string
+
+// flags given on the command line, the config file doesn't override them
+var commandLineFlags = make(map[string]bool)
+
+// limits checked outside main, nil when not set up (as in tests)
+var (
+	maxConnections *int64
+	maxMemory      *int64 // megabytes
+	maxItemSize    *int64
+)
+
+// default max-item-size, as memcached
+const defaultMaxItemSize = 1 << 20
+
+// largest data block the protocol can take
+const maxDataBytes = 1<<32 - 3
+
+// current value of a runtime setting
+func settingInt64(value *int64) int64 {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	return *value
+}
+
+func settingBool(value *bool) bool {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	return *value
+}
+
+// current value of any flag
+func getSetting(name string) (string, bool) {
+	f := flag.Lookup(name)
+	if f == nil {
+		return "", false
+	}
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	return f.Value.String(), true
+}
+
+// change a runtime setting
+func setSetting(name string, value string) os.Error {
+	if flag.Lookup(name) == nil {
+		return os.NewError("unknown setting " + name)
+	}
+	apply, runtime := runtimeSettings[name]
+	if !runtime {
+		return os.NewError(name + " can't be changed while running")
+	}
+	settingsLock.Lock()
+	set := flag.Set(name, value)
+	settingsLock.Unlock()
+	if !set {
+		return os.NewError(fmt.Sprintf("invalid value for %s: %s", name, value))
+	}
+	if apply != nil {
+		apply()
+	}
+	return nil
+}
+
+type configLine struct {
+	line  int
+	name  string
+	value string
+}
+
+// Parse a config file into its settings
+func readConfig(path string) ([]configLine, os.Error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var settings []configLine
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		equals := strings.Index(line, "=")
+		if equals < 0 {
+			return nil, os.NewError(fmt.Sprintf("%s:%d: expected name = value", path, i+1))
+		}
+		name := strings.TrimSpace(line[:equals])
+		value := strings.TrimSpace(line[equals+1:])
+		if strings.HasPrefix(value, "\"") {
+			end := closingQuote(value)
+			rest := ""
+			if end > 0 {
+				rest = strings.TrimSpace(value[end+1:])
+			}
+			if end < 0 || rest != "" && rest[0] != '#' {
+				return nil, os.NewError(fmt.Sprintf("%s:%d: bad string value", path, i+1))
+			}
+			if value, err = strconv.Unquote(value[:end+1]); err != nil {
+				return nil, os.NewError(fmt.Sprintf("%s:%d: bad string value", path, i+1))
+			}
+		} else if comment := strings.Index(value, "#"); comment >= 0 {
+			value = strings.TrimSpace(value[:comment])
+		}
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, os.NewError(fmt.Sprintf("%s:%d: unknown setting %s", path, i+1, name))
+		}
+		settings = append(settings, configLine{i + 1, name, value})
+	}
+	return settings, nil
+}
+
+// index of the quote closing the string starting at value[0], -1 if none
+func closingQuote(value string) int {
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// Load the config file at startup, before any flag is used
+func loadConfig(path string) os.Error {
+	configPath = path
+	flag.Visit(func(f *flag.Flag) { commandLineFlags[f.Name] = true })
+	settings, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	for _, s := range settings {
+		if !commandLineFlags[s.name] && !flag.Set(s.name, s.value) {
+			return os.NewError(fmt.Sprintf("%s:%d: invalid value for %s: %s", path, s.line, s.name, s.value))
+		}
+	}
+	return nil
+}
+
+// Apply the runtime settings changed in the config file. A file with errors is
+// ignored entirely.
+func reloadConfig() os.Error {
+	if configPath == "" {
+		return os.NewError("no config file given")
+	}
+	settings, err := readConfig(configPath)
+	if err != nil {
+		return err
+	}
+	for _, s := range settings {
+		if commandLineFlags[s.name] {
+			continue
+		} else if current, _ := getSetting(s.name); current == s.value {
+			continue
+		} else if _, runtime := runtimeSettings[s.name]; !runtime {
+			logger.Info("Setting changed, it needs a restart", "name", s.name, "config", configPath)
+		} else if err := setSetting(s.name, s.value); err != nil {
+			logger.Error("Invalid setting", "config", configPath, "line", s.line, "err", err)
+		} else {
+			logger.Info("Setting changed", "name", s.name, "value", s.value)
+		}
+	}
+	return nil
+}
+
+// Reload the config file and the encryption keys on every SIGHUP. As every signal is delivered here, it also
+// exits on SIGINT and SIGTERM.
+func signalHandler() {
+	for sig := range signal.Incoming {
+		switch sig {
+		case os.SIGHUP:
+			logger.Info("Reloading config", "config", configPath)
+			if err := reloadConfig(); err != nil {
+				logger.Error("Unable to reload config", "err", err)
+			}
+			reloadFileKeys()
+		case os.SIGINT, os.SIGTERM:
+			logger.Info("Exiting", "signal", sig)
+			closeFileWriters()
+			os.Exit(0)
+		}
+	}
+}
+
+// open client connections
+var connections int64
+
+// client connections accepted and refused so far
+var acceptedConnections, refusedConnections uint64
+
+// Register a new client connection, returns false when over the connections limit
+func openConnection() bool {
+	open := atomic.AddInt64(&connections, 1)
+	if maxConnections != nil {
+		if limit := settingInt64(maxConnections); limit > 0 && open > limit {
+			atomic.AddInt64(&connections, -1)
+			atomic.AddUint64(&refusedConnections, 1)
+			return false
+		}
+	}
+	atomic.AddUint64(&acceptedConnections, 1)
+	return true
+}
+
+func closeConnection() {
+	atomic.AddInt64(&connections, -1)
+}
+
+// largest value accepted by storage commands
+func maxItemBytes() uint64 {
+	limit := int64(defaultMaxItemSize)
+	if maxItemSize != nil {
+		limit = settingInt64(maxItemSize)
+	}
+	if limit <= 0 || limit > maxDataBytes {
+		return maxDataBytes
+	}
+	return uint64(limit)
+}
+
+// whether the stored items reached the memory limit
+func memoryExhausted() bool {
+	if maxMemory == nil {
+		return false
+	}
+	limit := settingInt64(maxMemory)
+	return limit > 0 && atomic.AddInt64(&storedBytes, 0) >= limit<<20
+}
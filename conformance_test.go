@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"rand"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Every CacheStorage is checked against the same reference model. New backends just
+// need an entry here.
+var conformanceStorages = map[string]CacheStorageFactory{
+	"map":            func() CacheStorage { return newMapCacheStorage(serverClock) },
+	"lazy map":       func() CacheStorage { return newLazyMapCacheStorage(serverClock, func(key string) {}) },
+	"hashing":        func() CacheStorage { return newHashingStorage(4, base_storage_factory) },
+	"event notifier": func() CacheStorage { return newEventNotifierStorage(newMapCacheStorage(serverClock), newUpdateQueue(10), watches) },
+	"latency":        func() CacheStorage { return newLatencyStorage(newMapCacheStorage(serverClock), newLatencyStats()) },
+	"compressing":    func() CacheStorage { return newCompressingStorage(newMapCacheStorage(serverClock), 16) },
+}
+
+const (
+	conformanceSteps   = 5000
+	conformanceWorkers = 8
+)
+
+var conformanceValues = []string{"0", "1", "42", "abc", "18446744073709551615", "x y",
+	strings.Repeat("compressible ", 8)}
+
+// Reference model of a storage: a plain map without expired entries
+type modelEntry struct {
+	flags   uint32
+	exptime uint32
+	content string
+	cas     uint64 // as seen in the storage
+}
+
+type conformanceRun struct {
+	t       *testing.T
+	name    string
+	storage CacheStorage
+	random  *rand.Rand
+	keys    []string
+	model   map[string]*modelEntry
+	cas     []uint64 // every cas unique seen, in order
+	failed  bool
+}
+
+func newConformanceRun(t *testing.T, name string, storage CacheStorage, seed int64, keys []string) *conformanceRun {
+	return &conformanceRun{t, name, storage, rand.New(rand.NewSource(seed)), keys, make(map[string]*modelEntry), nil, false}
+}
+
+// model entry for key, nil if absent or expired
+func (self *conformanceRun) live(key string) *modelEntry {
+	entry := self.model[key]
+	if entry != nil && entry.exptime != 0 && entry.exptime <= uint32(serverClock.Seconds()) {
+		self.model[key] = nil, false
+		return nil
+	}
+	return entry
+}
+
+// never, already expired or far in the future
+func (self *conformanceRun) exptime() uint32 {
+	switch self.random.Intn(8) {
+	case 0:
+		return 1000000000
+	case 1:
+		return uint32(serverClock.Seconds()) + 3600
+	}
+	return 0
+}
+
+func (self *conformanceRun) value() string {
+	return conformanceValues[self.random.Intn(len(conformanceValues))]
+}
+
+// Report the first difference, the run stops there
+func (self *conformanceRun) fail(step int, op string, key string, format string, args ...interface{}) {
+	self.failed = true
+	self.t.Errorf("%s: step %d: %s %s: %s", self.name, step, op, key, fmt.Sprintf(format, args...))
+}
+
+// Check an operation result against the model, which has already been updated. Every
+// modification must assign a cas unique greater than any seen before.
+func (self *conformanceRun) check(step int, op string, key string, err ErrorCode, expected ErrorCode, result *StorageEntry) {
+	if err != expected {
+		self.fail(step, op, key, "expected error %d, got %d", expected, err)
+		return
+	}
+	if expected != Ok || result == nil {
+		return
+	}
+	entry := self.model[key]
+	if string(result.content) != entry.content || result.flags != entry.flags ||
+		result.exptime != entry.exptime || result.bytes != uint32(len(entry.content)) {
+		self.fail(step, op, key, "expected %v, got %d %d %d %q", *entry, result.flags, result.exptime, result.bytes, result.content)
+	} else if op == "get" && result.cas_unique != entry.cas {
+		self.fail(step, op, key, "expected cas %d, got %d", entry.cas, result.cas_unique)
+	} else if op != "get" && len(self.cas) > 0 && result.cas_unique <= self.cas[len(self.cas)-1] {
+		self.fail(step, op, key, "cas %d not greater than %d", result.cas_unique, self.cas[len(self.cas)-1])
+	} else if op != "get" {
+		self.cas = append(self.cas, result.cas_unique)
+		entry.cas = result.cas_unique
+	}
+}
+
+// the current cas unique of an entry, or a stale one, maybe of a deleted entry
+func (self *conformanceRun) casUnique(current *modelEntry) uint64 {
+	if current != nil && self.random.Intn(2) == 0 {
+		return current.cas
+	} else if len(self.cas) > 0 {
+		return self.cas[self.random.Intn(len(self.cas))]
+	}
+	return 0
+}
+
+func (self *conformanceRun) step(step int) {
+	key := self.keys[self.random.Intn(len(self.keys))]
+	flags, exptime, value := uint32(self.random.Intn(4)), self.exptime(), self.value()
+	content := []byte(value)
+	bytes := uint32(len(content))
+	current := self.live(key)
+	stored := &modelEntry{flags, exptime, value, 0}
+	switch op := self.random.Intn(12); op {
+	case 0:
+		_, result := self.storage.Set(key, flags, exptime, bytes, content)
+		self.model[key] = stored
+		self.check(step, "set", key, Ok, Ok, result)
+	case 1:
+		err, result := self.storage.Add(key, flags, exptime, bytes, content)
+		expected := ErrorCode(KeyAlreadyInUse)
+		if current == nil {
+			self.model[key] = stored
+			expected = Ok
+		}
+		self.check(step, "add", key, err, expected, result)
+	case 2:
+		err, _, result := self.storage.Replace(key, flags, exptime, bytes, content)
+		expected := ErrorCode(KeyNotFound)
+		if current != nil {
+			self.model[key] = stored
+			expected = Ok
+		}
+		self.check(step, "replace", key, err, expected, result)
+	case 3, 4:
+		var err ErrorCode
+		var result *StorageEntry
+		if op == 3 {
+			err, _, result = self.storage.Append(key, bytes, content)
+		} else {
+			err, _, result = self.storage.Prepend(key, bytes, content)
+		}
+		expected := ErrorCode(KeyNotFound)
+		if current != nil {
+			if op == 3 {
+				current.content += value
+			} else {
+				current.content = value + current.content
+			}
+			expected = Ok
+		}
+		self.check(step, "append/prepend", key, err, expected, result)
+	case 5:
+		cas := self.casUnique(current)
+		err, _, result := self.storage.Cas(key, flags, exptime, bytes, cas, content)
+		expected := ErrorCode(KeyNotFound)
+		if current != nil && cas == current.cas {
+			self.model[key] = stored
+			expected = Ok
+		} else if current != nil {
+			expected = IllegalParameter
+		}
+		self.check(step, "cas", key, err, expected, result)
+	case 6, 7:
+		err, result := self.storage.Get(key)
+		expected := ErrorCode(KeyNotFound)
+		if current != nil {
+			expected = Ok
+		}
+		self.check(step, "get", key, err, expected, result)
+	case 8:
+		var err ErrorCode
+		unconditional, cas := self.random.Intn(2) == 0, self.casUnique(current)
+		if unconditional {
+			err, _ = self.storage.Delete(key)
+		} else {
+			err, _ = self.storage.CasDelete(key, cas)
+		}
+		expected := ErrorCode(KeyNotFound)
+		if current != nil && (unconditional || cas == current.cas) {
+			self.model[key] = nil, false
+			expected = Ok
+		} else if current != nil {
+			expected = IllegalParameter
+		}
+		self.check(step, "delete", key, err, expected, nil)
+	case 9:
+		delta, incr := uint64(self.random.Intn(100)), self.random.Intn(2) == 0
+		err, _, result := self.storage.Incr(key, delta, incr)
+		expected := ErrorCode(KeyNotFound)
+		if current != nil {
+			if number, parseErr := strconv.Atoui64(current.content); parseErr != nil {
+				expected = IllegalParameter
+			} else {
+				if incr {
+					number += delta
+				} else if delta > number {
+					number = 0
+				} else {
+					number -= delta
+				}
+				current.content = strconv.Uitoa64(number)
+				expected = Ok
+			}
+		}
+		self.check(step, "incr/decr", key, err, expected, result)
+	case 10:
+		err, _, result := self.storage.Touch(key, exptime)
+		expected := ErrorCode(KeyNotFound)
+		if current != nil {
+			current.exptime = exptime
+			expected = Ok
+		}
+		self.check(step, "touch", key, err, expected, result)
+	case 11:
+		keys := []string{key}
+		for len(keys) < 1+self.random.Intn(8) {
+			keys = append(keys, self.keys[self.random.Intn(len(self.keys))])
+		}
+		for i, result := range self.storage.GetMulti(keys) {
+			expected := ErrorCode(KeyNotFound)
+			if self.live(keys[i]) != nil {
+				expected = Ok
+			}
+			err := ErrorCode(Ok)
+			if result == nil {
+				err = KeyNotFound
+			}
+			self.check(step, "get", keys[i], err, expected, result)
+		}
+	}
+}
+
+func conformanceKeys(prefix string, count int) []string {
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = prefix + strconv.Itoa(i)
+	}
+	return keys
+}
+
+func TestStorageConformance(t *testing.T) {
+	for name, factory := range conformanceStorages {
+		run := newConformanceRun(t, name, factory(), 1, conformanceKeys("key", 16))
+		for step := 0; step < conformanceSteps && !run.failed; step++ {
+			run.step(step)
+		}
+	}
+}
+
+// Workers with their own keys and models share a storage, while others go through every
+// key and the whole storage, meant to be run under the race detector. Hashing storages
+// are repartitioned meanwhile.
+func TestStorageConformanceConcurrently(t *testing.T) {
+	for name, factory := range conformanceStorages {
+		storage := factory()
+		var workers sync.WaitGroup
+		if hashing, ok := storage.(*HashingStorage); ok {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				for _, size := range []uint32{7, 1, 16} {
+					// until the previous resize is done migrating
+					for hashing.Resize(size) != nil {
+						time.Sleep(1e6)
+					}
+				}
+			}()
+		}
+		for i := 0; i < conformanceWorkers; i++ {
+			workers.Add(2)
+			run := newConformanceRun(t, name, storage, int64(i), conformanceKeys(fmt.Sprintf("worker%d-", i), 8))
+			go func() {
+				defer workers.Done()
+				for step := 0; step < conformanceSteps/conformanceWorkers && !run.failed; step++ {
+					run.step(step)
+				}
+			}()
+			go func(seed int64) {
+				defer workers.Done()
+				random := rand.New(rand.NewSource(seed))
+				for step := 0; step < conformanceSteps/conformanceWorkers; step++ {
+					key := fmt.Sprintf("worker%d-%d", random.Intn(conformanceWorkers), random.Intn(8))
+					if random.Intn(100) == 0 {
+						storage.Iterate(func(key string, entry *StorageEntry) bool { return len(entry.content) >= 0 })
+					} else if err, entry := storage.Get(key); err == Ok && uint32(len(entry.content)) != entry.bytes {
+						t.Errorf("%s: %s: %d bytes, content %q", name, key, entry.bytes, entry.content)
+					} else if err != Ok {
+						storage.Expire(key, true)
+					}
+				}
+			}(int64(i))
+		}
+		workers.Wait()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encryption"
+	"io"
+	"os"
+	"sync"
+)
+
+// keys encrypting the files written, nil when they are written in the clear
+var fileKeys *encryption.Keyring
+
+// writers of the encrypted files, ended when the server exits
+var (
+	fileWritersLock sync.Mutex
+	fileWriters     []*encryption.Writer
+)
+
+// writer of a file produced by the server, encrypting it when keys were given
+func fileWriter(file *os.File) io.Writer {
+	if fileKeys == nil {
+		return file
+	}
+	writer := encryption.NewWriter(file, fileKeys)
+	fileWritersLock.Lock()
+	fileWriters = append(fileWriters, writer)
+	fileWritersLock.Unlock()
+	return writer
+}
+
+// End the records of the encrypted files, otherwise they read as truncated
+func closeFileWriters() {
+	fileWritersLock.Lock()
+	defer fileWritersLock.Unlock()
+	for _, writer := range fileWriters {
+		if err := writer.Close(); err != nil {
+			logger.Error("Unable to end an encrypted file", "err", err)
+		}
+	}
+}
+
+// Write the plaintext of an encrypted file to w
+func decryptFile(path string, keys *encryption.Keyring, w io.Writer) os.Error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, encryption.NewReader(file, keys))
+	return err
+}
+
+// Read the key file again, new records are written with its last key
+func reloadFileKeys() {
+	if fileKeys == nil {
+		return
+	}
+	if err := fileKeys.Reload(); err != nil {
+		logger.Error("Unable to reload the encryption keys", "err", err)
+	} else {
+		logger.Info("Encryption keys reloaded", "current", fileKeys.Current())
+	}
+}
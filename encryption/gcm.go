@@ -0,0 +1,153 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"os"
+)
+
+const (
+	NonceSize = 12
+	TagSize   = 16
+)
+
+// element of GF(2^128), bit 0 of the field is the top bit of hi
+type fieldElement struct {
+	hi, lo uint64
+}
+
+// Galois/Counter Mode (NIST SP 800-38D) over a 128 bits block cipher, authenticating
+// the ciphertext along with some unencrypted data. Safe for concurrent use.
+type GCM struct {
+	block cipher.Block
+	h     fieldElement // hash key, the encrypted zero block
+}
+
+func NewGCM(block cipher.Block) (*GCM, os.Error) {
+	if block.BlockSize() != 16 {
+		return nil, os.NewError("GCM needs a 128 bits block cipher")
+	}
+	var zero [16]byte
+	block.Encrypt(zero[:], zero[:])
+	return &GCM{block, fieldElement{binary.BigEndian.Uint64(zero[:8]), binary.BigEndian.Uint64(zero[8:])}}, nil
+}
+
+// Append plaintext encrypted and its tag to dst. A nonce must never be used twice
+// with the same key.
+func (self *GCM) Seal(dst []byte, nonce []byte, plaintext []byte, data []byte) []byte {
+	if len(nonce) != NonceSize {
+		panic("encryption: bad nonce length")
+	}
+	var counter, tagMask [16]byte
+	self.start(nonce, &counter, &tagMask)
+	sealed := make([]byte, len(plaintext)+TagSize)
+	self.counterXor(sealed, plaintext, &counter)
+	tag := self.auth(sealed[:len(plaintext)], data, &tagMask)
+	copy(sealed[len(plaintext):], tag[:])
+	return append(dst, sealed...)
+}
+
+// Append to dst the plaintext of sealed, if it and data are authentic
+func (self *GCM) Open(dst []byte, nonce []byte, sealed []byte, data []byte) ([]byte, os.Error) {
+	if len(nonce) != NonceSize {
+		return nil, os.NewError("bad nonce length")
+	} else if len(sealed) < TagSize {
+		return nil, os.NewError("message too short")
+	}
+	var counter, tagMask [16]byte
+	self.start(nonce, &counter, &tagMask)
+	ciphertext := sealed[:len(sealed)-TagSize]
+	tag := self.auth(ciphertext, data, &tagMask)
+	if subtle.ConstantTimeCompare(tag[:], sealed[len(ciphertext):]) != 1 {
+		return nil, os.NewError("message authentication failed")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	self.counterXor(plaintext, ciphertext, &counter)
+	return append(dst, plaintext...), nil
+}
+
+// first counter block of a message, and the mask of its tag
+func (self *GCM) start(nonce []byte, counter *[16]byte, tagMask *[16]byte) {
+	copy(counter[:], nonce)
+	counter[15] = 1
+	self.block.Encrypt(tagMask[:], counter[:])
+	increment(counter)
+}
+
+// increment the last 32 bits of a counter block
+func increment(counter *[16]byte) {
+	for i := 15; i >= 12; i-- {
+		counter[i]++
+		if counter[i] != 0 {
+			return
+		}
+	}
+}
+
+// counter mode encryption, which is also the decryption
+func (self *GCM) counterXor(out []byte, in []byte, counter *[16]byte) {
+	var mask [16]byte
+	for len(in) > 0 {
+		self.block.Encrypt(mask[:], counter[:])
+		increment(counter)
+		n := len(in)
+		if n > 16 {
+			n = 16
+		}
+		for i := 0; i < n; i++ {
+			out[i] = in[i] ^ mask[i]
+		}
+		in, out = in[n:], out[n:]
+	}
+}
+
+// authentication tag of a ciphertext and its additional data
+func (self *GCM) auth(ciphertext []byte, data []byte, tagMask *[16]byte) [16]byte {
+	var y fieldElement
+	y = self.ghash(y, data)
+	y = self.ghash(y, ciphertext)
+	y.hi ^= uint64(len(data)) * 8
+	y.lo ^= uint64(len(ciphertext)) * 8
+	y = multiply(y, self.h)
+	var tag [16]byte
+	binary.BigEndian.PutUint64(tag[:8], y.hi)
+	binary.BigEndian.PutUint64(tag[8:], y.lo)
+	for i := range tag {
+		tag[i] ^= tagMask[i]
+	}
+	return tag
+}
+
+// hash blocks into y, the last one padded with zeros
+func (self *GCM) ghash(y fieldElement, blocks []byte) fieldElement {
+	for len(blocks) > 0 {
+		var block [16]byte
+		n := copy(block[:], blocks)
+		blocks = blocks[n:]
+		y.hi ^= binary.BigEndian.Uint64(block[:8])
+		y.lo ^= binary.BigEndian.Uint64(block[8:])
+		y = multiply(y, self.h)
+	}
+	return y
+}
+
+// x*y in GF(2^128), without branching on their bits
+func multiply(x fieldElement, y fieldElement) fieldElement {
+	var z fieldElement
+	v := y
+	for i := uint(0); i < 128; i++ {
+		var bit uint64
+		if i < 64 {
+			bit = x.hi >> (63 - i) & 1
+		} else {
+			bit = x.lo >> (127 - i) & 1
+		}
+		z.hi ^= v.hi & -bit
+		z.lo ^= v.lo & -bit
+		carry := v.lo & 1
+		v.lo = v.lo>>1 | v.hi<<63
+		v.hi = v.hi>>1 ^ 0xe100000000000000&-carry
+	}
+	return z
+}
@@ -0,0 +1,63 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+)
+
+// test cases from the GCM specification, by McGrew and Viega
+var gcmVectors = []struct {
+	key, nonce, plaintext, data, ciphertext, tag string
+}{
+	{"00000000000000000000000000000000", "000000000000000000000000", "", "", "", "58e2fccefa7e3061367f1d57a4e7455a"},
+	{"00000000000000000000000000000000", "000000000000000000000000", "00000000000000000000000000000000", "",
+		"0388dace60b6a392f328c2b971b2fe78", "ab6e47d42cec13bdf53a67b21257bddf"},
+	{"feffe9928665731c6d6a8f9467308308", "cafebabefacedbaddecaf888",
+		"d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a721c3c0c95956809532fcf0e2449a6b525b16aedf5aa0de657ba637b391aafd255", "",
+		"42831ec2217774244b7221b784d0d49ce3aa212f2c02a4e035c17e2329aca12e21d514b25466931c7d8f6a5aac84aa051ba30b396a0aac973d58e091473f5985",
+		"4d5c2af327cd64a62cf35abd2ba6fab4"},
+	{"feffe9928665731c6d6a8f9467308308", "cafebabefacedbaddecaf888",
+		"d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a721c3c0c95956809532fcf0e2449a6b525b16aedf5aa0de657ba637b39",
+		"feedfacedeadbeeffeedfacedeadbeefabaddad2",
+		"42831ec2217774244b7221b784d0d49ce3aa212f2c02a4e035c17e2329aca12e21d514b25466931c7d8f6a5aac84aa051ba30b396a0aac973d58e091",
+		"5bc94fbc3221a5db94fae95ae7121a47"},
+	{"feffe9928665731c6d6a8f9467308308feffe9928665731c6d6a8f9467308308", "cafebabefacedbaddecaf888",
+		"d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a721c3c0c95956809532fcf0e2449a6b525b16aedf5aa0de657ba637b39",
+		"feedfacedeadbeeffeedfacedeadbeefabaddad2",
+		"522dc1f099567d07f47f37a32a84427d643a8cdcbfe5c0c97598a2bd2555d1aa8cb08e48590dbb3da7b08b1056828838c5f61e6393ba7a0abcc9f662",
+		"76fc6ece0f4e1768cddf8853bb2d551b"},
+}
+
+func decode(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal("Bad test vector", s)
+	}
+	return b
+}
+
+func TestGCMVectors(t *testing.T) {
+	for i, v := range gcmVectors {
+		block, _ := aes.NewCipher(decode(t, v.key))
+		gcm, _ := NewGCM(block)
+		nonce, plaintext, data := decode(t, v.nonce), decode(t, v.plaintext), decode(t, v.data)
+		expected := append(decode(t, v.ciphertext), decode(t, v.tag)...)
+		sealed := gcm.Seal(nil, nonce, plaintext, data)
+		if !bytes.Equal(sealed, expected) {
+			t.Errorf("%d: expected %x, sealed %x", i, expected, sealed)
+		}
+		if opened, err := gcm.Open(nil, nonce, sealed, data); err != nil || !bytes.Equal(opened, plaintext) {
+			t.Errorf("%d: unable to open, %v", i, err)
+		}
+		sealed[0] ^= 1
+		if _, err := gcm.Open(nil, nonce, sealed, data); err == nil {
+			t.Errorf("%d: opened a tampered message", i)
+		}
+		sealed[0] ^= 1
+		if _, err := gcm.Open(nil, nonce, sealed, append(data, 0)); err == nil {
+			t.Errorf("%d: opened a message with other data", i)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Keys read from a key file, with an id and a hex encoded AES key per line, like
+//   2011-10 8c2d1a0f5e6b7c3d9e0f1a2b3c4d5e6f8c2d1a0f5e6b7c3d9e0f1a2b3c4d5e6f
+// Blank lines and lines starting with # are ignored. The last key encrypts and every
+// key decrypts, so keys are rotated by appending a new one and reloading the file.
+type Keyring struct {
+	path    string
+	lock    sync.RWMutex
+	keys    map[string]*GCM
+	current string
+}
+
+func LoadKeyring(path string) (*Keyring, os.Error) {
+	keyring := &Keyring{path: path}
+	if err := keyring.Reload(); err != nil {
+		return nil, err
+	}
+	return keyring, nil
+}
+
+// Read the key file again. A file with errors is ignored entirely.
+func (self *Keyring) Reload() os.Error {
+	content, err := ioutil.ReadFile(self.path)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]*GCM)
+	current := ""
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) > 255 {
+			return os.NewError(fmt.Sprintf("%s:%d: expected a key id and a hex key", self.path, i+1))
+		} else if _, present := keys[fields[0]]; present {
+			return os.NewError(fmt.Sprintf("%s:%d: key %s repeated", self.path, i+1, fields[0]))
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			return os.NewError(fmt.Sprintf("%s:%d: bad key, expected 16, 24 or 32 hex encoded bytes", self.path, i+1))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		if keys[fields[0]], err = NewGCM(block); err != nil {
+			return err
+		}
+		current = fields[0]
+	}
+	if current == "" {
+		return os.NewError(self.path + ": no keys")
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.keys, self.current = keys, current
+	return nil
+}
+
+// id of the key encrypting
+func (self *Keyring) Current() string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.current
+}
+
+// the key encrypting and its id
+func (self *Keyring) currentKey() (string, *GCM) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.current, self.keys[self.current]
+}
+
+// key with id, nil if unknown
+func (self *Keyring) key(id string) *GCM {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.keys[id]
+}
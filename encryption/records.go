@@ -0,0 +1,176 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	// largest record read, so that a corrupted length can't exhaust the memory
+	MaxRecordSize = 16 << 20
+	// size of the random id of the records written by a Writer
+	WriterIdSize = 16
+)
+
+// Records are missing where the reader expected more, like the end of a writer
+var ErrMissingRecords = os.NewError("encrypted records missing")
+
+// Writes every Write as an encrypted record, made of the length of the key id (a byte),
+// the key id, the writer id, a random nonce, the length of the sealed data (4 big
+// endian bytes) and the sealed data. Every record is authenticated along with the
+// writer id, its sequence number among the records of the writer and the key id, so
+// records can't be dropped, reordered or moved between files. Close ends the records
+// with an empty one, so a file cut at a record boundary doesn't read as complete.
+// Writers may append to a file after the records of others: only the removal of every
+// record of a writer goes unnoticed.
+type Writer struct {
+	w        io.Writer
+	keys     *Keyring
+	lock     sync.Mutex
+	id       []byte // random, drawn with the first record
+	sequence uint64 // of the next record
+	closed   bool
+}
+
+func NewWriter(w io.Writer, keys *Keyring) *Writer {
+	return &Writer{w: w, keys: keys}
+}
+
+func (self *Writer) Write(p []byte) (int, os.Error) {
+	if len(p) > MaxRecordSize-TagSize {
+		return 0, os.NewError("record too large")
+	} else if len(p) == 0 {
+		// an empty record ends the writer
+		return 0, nil
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return 0, os.NewError("writer closed")
+	} else if err := self.seal(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Write the record ending the writer, further writes fail. The underlying writer is
+// left open.
+func (self *Writer) Close() os.Error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return nil
+	}
+	self.closed = true
+	return self.seal(nil)
+}
+
+// write the record of plaintext, must be called with the lock held
+func (self *Writer) seal(plaintext []byte) os.Error {
+	if self.id == nil {
+		id := make([]byte, WriterIdSize)
+		if _, err := io.ReadFull(rand.Reader, id); err != nil {
+			return err
+		}
+		self.id = id
+	}
+	keyId, key := self.keys.currentKey()
+	headerSize := 1 + len(keyId) + WriterIdSize + NonceSize + 4
+	record := make([]byte, headerSize, headerSize+len(plaintext)+TagSize)
+	record[0] = byte(len(keyId))
+	copy(record[1:], keyId)
+	copy(record[1+len(keyId):], self.id)
+	nonce := record[1+len(keyId)+WriterIdSize : headerSize-4]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(record[headerSize-4:], uint32(len(plaintext)+TagSize))
+	record = key.Seal(record, nonce, plaintext, additionalData(self.id, self.sequence, keyId))
+	if _, err := self.w.Write(record); err != nil {
+		return err
+	}
+	self.sequence += 1
+	return nil
+}
+
+// data authenticated along with a record
+func additionalData(writer []byte, sequence uint64, keyId string) []byte {
+	data := make([]byte, WriterIdSize+8, WriterIdSize+8+len(keyId))
+	copy(data, writer)
+	binary.BigEndian.PutUint64(data[WriterIdSize:], sequence)
+	return append(data, keyId...)
+}
+
+// Reads the plaintext of the records written by Writers, with any key of the keyring.
+// Fails with ErrMissingRecords when the records of a writer stop before its end.
+type Reader struct {
+	r        *bufio.Reader
+	keys     *Keyring
+	pending  []byte // plaintext of the last record not read yet
+	writer   []byte // id of the writer of the records read, nil after its end
+	sequence uint64 // of the next record of the writer
+}
+
+func NewReader(r io.Reader, keys *Keyring) *Reader {
+	return &Reader{r: bufio.NewReader(r), keys: keys}
+}
+
+func (self *Reader) Read(p []byte) (int, os.Error) {
+	for len(self.pending) == 0 {
+		var err os.Error
+		if self.pending, err = self.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, self.pending)
+	self.pending = self.pending[n:]
+	return n, nil
+}
+
+// plaintext of the next record, empty for the end of a writer and os.EOF after the
+// end of the last one
+func (self *Reader) next() ([]byte, os.Error) {
+	idLength, err := self.r.ReadByte()
+	if err == os.EOF && self.writer != nil {
+		return nil, ErrMissingRecords
+	} else if err != nil {
+		return nil, err
+	}
+	header := make([]byte, int(idLength)+WriterIdSize+NonceSize+4)
+	if _, err := io.ReadFull(self.r, header); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	keyId := string(header[:idLength])
+	writer := header[idLength : int(idLength)+WriterIdSize]
+	nonce := header[int(idLength)+WriterIdSize : len(header)-4]
+	length := binary.BigEndian.Uint32(header[len(header)-4:])
+	if length > MaxRecordSize {
+		return nil, os.NewError("record too large")
+	} else if self.writer == nil {
+		self.writer, self.sequence = writer, 0
+	} else if !bytes.Equal(writer, self.writer) {
+		return nil, ErrMissingRecords
+	}
+	key := self.keys.key(keyId)
+	if key == nil {
+		return nil, os.NewError("unknown key " + keyId)
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(self.r, sealed); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	plaintext, err := key.Open(nil, nonce, sealed, additionalData(self.writer, self.sequence, keyId))
+	if err != nil {
+		return nil, err
+	}
+	self.sequence += 1
+	if len(plaintext) == 0 {
+		self.writer = nil
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,117 @@
+package encryption
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+const (
+	oldKey = "old 000102030405060708090a0b0c0d0e0f\n"
+	newKey = "new 101112131415161718191a1b1c1d1e1f101112131415161718191a1b1c1d1e1f\n"
+)
+
+func writeKeys(t *testing.T, file string, keys string) {
+	if err := ioutil.WriteFile(file, []byte(keys), 0600); err != nil {
+		t.Fatal("Unable to write the key file:", err)
+	}
+}
+
+func TestRecordsAcrossRotation(t *testing.T) {
+	file := path.Join(os.TempDir(), "gocached-keys-test")
+	defer os.Remove(file)
+	writeKeys(t, file, "# test keys\n"+oldKey)
+	keys, err := LoadKeyring(file)
+	if err != nil {
+		t.Fatal("Unable to load the keys:", err)
+	}
+	var encrypted bytes.Buffer
+	writer := NewWriter(&encrypted, keys)
+	writer.Write([]byte("first line\n"))
+
+	writeKeys(t, file, oldKey+newKey)
+	if err := keys.Reload(); err != nil || keys.Current() != "new" {
+		t.Fatal("Unable to rotate the keys:", err)
+	}
+	writer.Write([]byte("second line\n"))
+	writer.Close()
+	if bytes.Contains(encrypted.Bytes(), []byte("line")) {
+		t.Error("Plaintext written")
+	}
+
+	plaintext, err := ioutil.ReadAll(NewReader(bytes.NewBuffer(encrypted.Bytes()), keys))
+	if err != nil || string(plaintext) != "first line\nsecond line\n" {
+		t.Errorf("Read %q, %v", plaintext, err)
+	}
+
+	truncated := encrypted.Bytes()[:encrypted.Len()-1]
+	if _, err := ioutil.ReadAll(NewReader(bytes.NewBuffer(truncated), keys)); err == nil {
+		t.Error("Read a truncated record")
+	}
+
+	writeKeys(t, file, newKey)
+	keys.Reload()
+	if _, err := ioutil.ReadAll(NewReader(bytes.NewBuffer(encrypted.Bytes()), keys)); err == nil {
+		t.Error("Read a record of a key removed")
+	}
+}
+
+// Every record written, apart
+type recordList [][]byte
+
+func (self *recordList) Write(p []byte) (int, os.Error) {
+	*self = append(*self, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func TestRecordsKeepTheirPosition(t *testing.T) {
+	file := path.Join(os.TempDir(), "gocached-keys-test")
+	defer os.Remove(file)
+	writeKeys(t, file, oldKey)
+	keys, err := LoadKeyring(file)
+	if err != nil {
+		t.Fatal("Unable to load the keys:", err)
+	}
+	var first, second recordList
+	for _, records := range []*recordList{&first, &second} {
+		writer := NewWriter(records, keys)
+		for _, line := range []string{"a\n", "b\n", "c\n"} {
+			writer.Write([]byte(line))
+		}
+		writer.Close()
+	}
+	read := func(records ...[]byte) (string, os.Error) {
+		plaintext, err := ioutil.ReadAll(NewReader(bytes.NewBuffer(bytes.Join(records, nil)), keys))
+		return string(plaintext), err
+	}
+
+	if plaintext, err := read(append(first, second...)...); err != nil || plaintext != "a\nb\nc\na\nb\nc\n" {
+		t.Errorf("Read %q, %v from writers appending to the same file", plaintext, err)
+	}
+	for name, records := range map[string][][]byte{
+		"a truncated file":           first[:3],
+		"a dropped record":           {first[0], first[2], first[3]},
+		"a dropped first record":     first[1:],
+		"reordered records":          {first[1], first[0], first[2], first[3]},
+		"a duplicated record":        {first[0], first[0], first[1], first[2], first[3]},
+		"a record of another writer": {first[0], second[1], first[2], first[3]},
+		"writers cut before the end": {first[0], first[1], second[0], second[1], second[2], second[3]},
+	} {
+		if plaintext, err := read(records...); err == nil {
+			t.Errorf("Read %s: %q", name, plaintext)
+		}
+	}
+}
+
+func TestBadKeyFiles(t *testing.T) {
+	file := path.Join(os.TempDir(), "gocached-keys-test")
+	defer os.Remove(file)
+	for _, keys := range []string{"", "# no keys\n", "k 0011\n", "k nothex\n", "k\n", oldKey + oldKey} {
+		writeKeys(t, file, keys)
+		if _, err := LoadKeyring(file); err == nil {
+			t.Errorf("Loaded %q", keys)
+		}
+	}
+}
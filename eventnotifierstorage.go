@@ -1,8 +1,9 @@
 package main
 
 type EventNotifierStorage struct {
-  updatesChannel chan UpdateMessage
+  updates *UpdateQueue  // nil when nobody tracks expiration times
   storage CacheStorage
+  listeners []UpdateListener
 }
 
 type UpdateMessage struct {
@@ -16,26 +17,47 @@ const (
   Delete = iota
   Add
   Change
-  Collect
+  Touch
+  Expire  // removed by an expirer once expired
+  Evict   // removed by an expirer before expiring
 )
 
-func updateMessageLogger(updatesChannel chan UpdateMessage) {
-  for {
-    m := <-updatesChannel
-    logger.Printf("New message: op: %d, key: %s, currentEpoch: %d, newEpoch: %d", m.op, m.key, m.currentEpoch, m.newEpoch)
+// Receives every update done through an EventNotifierStorage. It's called synchronously
+// by the updating session, so it must never block.
+type UpdateListener interface {
+  Updated(msg UpdateMessage)
+}
+
+/* Logs every update at debug verbosity */
+type updateLogger struct{}
+
+func (self updateLogger) Updated(m UpdateMessage) {
+  if logger.Enabled(LogDebug) {
+    logger.Debug("Update", "op", updateOps[m.op], "key", m.key, "current_exptime", m.currentEpoch, "exptime", m.newEpoch)
   }
 }
 
-func newEventNotifierStorage(storage CacheStorage, updatesChannel chan UpdateMessage) *EventNotifierStorage {
-  return &EventNotifierStorage{updatesChannel, storage}
+func newEventNotifierStorage(storage CacheStorage, updates *UpdateQueue, listeners ...UpdateListener) *EventNotifierStorage {
+  return &EventNotifierStorage{updates, storage, listeners}
+}
+
+/* Expirations and evictions come from the expirer itself, so they are only
+   sent to the listeners. See Expirer for the updates contract */
+func (self *EventNotifierStorage) notify(msg UpdateMessage) {
+  for _, listener := range self.listeners {
+    listener.Updated(msg)
+  }
+  if self.updates != nil && msg.op != Expire && msg.op != Evict {
+    self.updates.Send(msg)
+  }
 }
 
 func (self *EventNotifierStorage) Set(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (*StorageEntry, *StorageEntry) {
   previous, updated := self.storage.Set(key, flags, exptime, bytes, content)
   if (previous != nil) {
-    self.updatesChannel <- UpdateMessage{Change, key, int64(previous.exptime), int64(exptime)}
+    self.notify(UpdateMessage{Change, key, int64(previous.exptime), int64(exptime)})
   } else {
-    self.updatesChannel <- UpdateMessage{Add, key, 0, int64(exptime)}
+    self.notify(UpdateMessage{Add, key, 0, int64(exptime)})
   }
   return previous, updated
 }
@@ -43,7 +65,7 @@ func (self *EventNotifierStorage) Set(key string, flags uint32, exptime uint32,
 func (self *EventNotifierStorage) Add(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (ErrorCode, *StorageEntry) {
   err, updatedEntry := self.storage.Add(key, flags, exptime, bytes, content)
   if (err == Ok) {
-    self.updatesChannel <- UpdateMessage{Add, key, 0, int64(exptime)}
+    self.notify(UpdateMessage{Add, key, 0, int64(exptime)})
   }
   return err, updatedEntry
 }
@@ -51,23 +73,31 @@ func (self *EventNotifierStorage) Add(key string, flags uint32, exptime uint32,
 func (self *EventNotifierStorage) Replace(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
   err, prev, updated := self.storage.Replace(key, flags, exptime, bytes, content)
   if (err == Ok) {
-    self.updatesChannel <- UpdateMessage{Change, key, int64(prev.exptime), int64(exptime)}
+    self.notify(UpdateMessage{Change, key, int64(prev.exptime), int64(exptime)})
   }
   return err, prev, updated
 }
 
 func (self *EventNotifierStorage) Append(key string, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
-  return self.storage.Append(key, bytes, content)
+  err, prev, updated := self.storage.Append(key, bytes, content)
+  if (err == Ok) {
+    self.notify(UpdateMessage{Change, key, int64(prev.exptime), int64(updated.exptime)})
+  }
+  return err, prev, updated
 }
 
 func (self *EventNotifierStorage) Prepend(key string, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
-  return self.storage.Prepend(key, bytes, content)
+  err, prev, updated := self.storage.Prepend(key, bytes, content)
+  if (err == Ok) {
+    self.notify(UpdateMessage{Change, key, int64(prev.exptime), int64(updated.exptime)})
+  }
+  return err, prev, updated
 }
 
 func (self *EventNotifierStorage) Cas(key string, flags uint32, exptime uint32, bytes uint32, cas_unique uint64, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
   err, prev, updated := self.storage.Cas(key, flags, exptime, bytes, cas_unique, content)
   if (err == Ok) {
-    self.updatesChannel <- UpdateMessage{Change, key, int64(prev.exptime), int64(exptime)}
+    self.notify(UpdateMessage{Change, key, int64(prev.exptime), int64(exptime)})
   }
   return err, prev, updated
 }
@@ -76,18 +106,63 @@ func (self *EventNotifierStorage) Get(key string) (err ErrorCode, result *Storag
   return self.storage.Get(key)
 }
 
+func (self *EventNotifierStorage) Peek(key string) (err ErrorCode, result *StorageEntry) {
+  return self.storage.Peek(key)
+}
+
+func (self *EventNotifierStorage) GetMulti(keys []string) []*StorageEntry {
+  return self.storage.GetMulti(keys)
+}
+
 func (self *EventNotifierStorage) Delete(key string) (ErrorCode, *StorageEntry) {
   err, deleted := self.storage.Delete(key)
   if (err == Ok) {
-    self.updatesChannel <- UpdateMessage{Delete, key, int64(deleted.exptime), 0}
+    self.notify(UpdateMessage{Delete, key, int64(deleted.exptime), 0})
+  }
+  return err, deleted
+}
+
+func (self *EventNotifierStorage) CasDelete(key string, cas_unique uint64) (ErrorCode, *StorageEntry) {
+  err, deleted := self.storage.CasDelete(key, cas_unique)
+  if (err == Ok) {
+    self.notify(UpdateMessage{Delete, key, int64(deleted.exptime), 0})
   }
   return err, deleted
 }
 
 func (self *EventNotifierStorage) Incr(key string, value uint64, incr bool) (ErrorCode, *StorageEntry, *StorageEntry) {
-  return self.storage.Incr(key, value, incr)
+  err, prev, updated := self.storage.Incr(key, value, incr)
+  if (err == Ok) {
+    self.notify(UpdateMessage{Change, key, int64(prev.exptime), int64(updated.exptime)})
+  }
+  return err, prev, updated
+}
+
+func (self *EventNotifierStorage) Touch(key string, exptime uint32) (ErrorCode, *StorageEntry, *StorageEntry) {
+  err, prev, updated := self.storage.Touch(key, exptime)
+  if (err == Ok) {
+    self.notify(UpdateMessage{Touch, key, int64(prev.exptime), int64(exptime)})
+  }
+  return err, prev, updated
+}
+
+func (self *EventNotifierStorage) Expire(key string, check bool) bool {
+  if !self.storage.Expire(key, check) {
+    return false
+  }
+  if check {
+    self.notify(UpdateMessage{Expire, key, 0, 0})
+  } else {
+    self.notify(UpdateMessage{Evict, key, 0, 0})
+  }
+  return true
+}
+
+/* Reports an entry the underlying storage expired by itself */
+func (self *EventNotifierStorage) Expired(key string) {
+  self.notify(UpdateMessage{Expire, key, 0, 0})
 }
 
-func (self *EventNotifierStorage) Expire(key string, check bool) {
-  self.storage.Expire(key, check)
+func (self *EventNotifierStorage) Iterate(visitor EntryVisitor) {
+  self.storage.Iterate(visitor)
 }
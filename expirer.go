@@ -0,0 +1,158 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Expiry contract
+//
+// Every successful mutation done through an EventNotifierStorage queues one UpdateMessage
+// with the key and its expiration time after the mutation (newEpoch, 0 meaning never):
+// Add for new keys, Change for set/replace/cas/append/prepend/incr/decr over an existing
+// key, Touch for touch and Delete for deletes. Concurrent writers may queue them in
+// another order than they stored, so an update schedules its key again with the
+// expiration time the storage holds when it's applied, which the update of the last
+// write always sees. Expirers keep at most one schedule per key and remove due entries
+// with Expire(key, true). As Expire only removes entries that did expire, and the
+// notifier only reports removals that actually happened, every item expires exactly
+// once even when a schedule is stale. A schedule that fires before its entry expired
+// is taken from the storage again.
+type Expirer interface {
+	// Track key to be expired at exptime, replacing any previous schedule for it.
+	// An exptime of 0 means the key never expires.
+	Schedule(key string, exptime int64)
+	// Stop tracking key
+	Unschedule(key string)
+	// Expire every entry due at now
+	Collect(now int64)
+	// Drop every schedule
+	Reset()
+}
+
+// expirer activity, read by the metrics
+var expirerStats struct {
+	collections     uint64
+	collectionNanos uint64
+	expired         uint64
+	rescheduled     uint64
+	resyncs         uint64
+}
+
+// Bounded queue of updates for an expirer. Sending never blocks the writers: when the
+// queue is full the update is dropped and the queue is flagged as overflowed, so the
+// expirer rebuilds its schedules from the storage on its next collection.
+type UpdateQueue struct {
+	updates    chan UpdateMessage
+	overflowed int32
+	dropped    uint64
+}
+
+func newUpdateQueue(size int) *UpdateQueue {
+	return &UpdateQueue{updates: make(chan UpdateMessage, size)}
+}
+
+func (self *UpdateQueue) Send(msg UpdateMessage) {
+	select {
+	case self.updates <- msg:
+	default:
+		atomic.AddUint64(&self.dropped, 1)
+		atomic.CompareAndSwapInt32(&self.overflowed, 0, 1)
+	}
+}
+
+// whether updates were dropped since the last call
+func (self *UpdateQueue) takeOverflow() bool {
+	return atomic.CompareAndSwapInt32(&self.overflowed, 1, 0)
+}
+
+// Apply an update to the expirer schedules, as the key is in the storage now. An entry
+// that expired meanwhile is removed right away.
+func applyUpdate(expirer Expirer, storage CacheStorage, msg UpdateMessage) {
+	if err, entry := storage.Peek(msg.key); err == Ok {
+		expirer.Schedule(msg.key, int64(entry.exptime))
+		return
+	}
+	expirer.Unschedule(msg.key)
+	if storage.Expire(msg.key, true) {
+		atomic.AddUint64(&expirerStats.expired, 1)
+		logger.Debug("Expired", "key", msg.key)
+	}
+}
+
+// Apply every queued update, without waiting for more
+func drainUpdates(expirer Expirer, queue *UpdateQueue, storage CacheStorage) {
+	for {
+		select {
+		case msg := <-queue.updates:
+			applyUpdate(expirer, storage, msg)
+		default:
+			return
+		}
+	}
+}
+
+// Expire the entries due at now. If updates were lost, queued ones are discarded
+// and the schedules are rebuilt from the storage first.
+func expirerTick(expirer Expirer, queue *UpdateQueue, storage CacheStorage, now int64) {
+	start := time.Nanoseconds()
+	if queue.takeOverflow() {
+		logger.Verbose("Expiry updates dropped, rebuilding schedules", "dropped", atomic.AddUint64(&queue.dropped, 0))
+		atomic.AddUint64(&expirerStats.resyncs, 1)
+		for drained := false; !drained; {
+			select {
+			case <-queue.updates:
+			default:
+				drained = true
+			}
+		}
+		expirer.Reset()
+		var keys []string
+		var exptimes []int64
+		storage.Iterate(func(key string, entry *StorageEntry) bool {
+			keys = append(keys, key)
+			exptimes = append(exptimes, int64(entry.exptime))
+			return true
+		})
+		for i, key := range keys {
+			expirer.Schedule(key, exptimes[i])
+		}
+	}
+	expirer.Collect(now)
+	atomic.AddUint64(&expirerStats.collections, 1)
+	atomic.AddUint64(&expirerStats.collectionNanos, uint64(time.Nanoseconds()-start))
+}
+
+// Expire key if due. Otherwise its schedule was stale, so it's scheduled again with
+// the current expiration time of the entry, if any. Returns whether key expired.
+func expireOrReschedule(expirer Expirer, storage CacheStorage, key string) bool {
+	if storage.Expire(key, true) {
+		atomic.AddUint64(&expirerStats.expired, 1)
+		logger.Debug("Expired", "key", key)
+		return true
+	}
+	if err, entry := storage.Peek(key); err == Ok && entry.exptime != 0 {
+		atomic.AddUint64(&expirerStats.rescheduled, 1)
+		logger.Debug("Rescheduled", "key", key, "exptime", entry.exptime)
+		expirer.Schedule(key, int64(entry.exptime))
+	}
+	return false
+}
+
+// Expirer main loop, applies updates as they come and collects every frequency seconds
+// of clock. The frequency is a runtime setting, so it's checked every second.
+func runExpirer(expirer Expirer, queue *UpdateQueue, storage CacheStorage, frequency *int64, clock Clock) {
+	ticker := time.NewTicker(1e9)
+	var collected int64
+	for {
+		select {
+		case msg := <-queue.updates:
+			applyUpdate(expirer, storage, msg)
+		case <-ticker.C:
+			if now := clock.Seconds(); now-collected >= settingInt64(frequency) {
+				collected = now
+				expirerTick(expirer, queue, storage, collected)
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"rand"
+	"sync"
+	"testing"
+)
+
+// counts the expirations reported for each key
+type expirationCounter map[string]int
+
+func (self expirationCounter) Updated(msg UpdateMessage) {
+	if msg.op == Expire {
+		self[msg.key] += 1
+	}
+}
+
+type expirerFactory func(storage CacheStorage, clock Clock) Expirer
+
+var expirerFactories = map[string]expirerFactory{
+	"generational": func(storage CacheStorage, clock Clock) Expirer { return newGenerationalStorage(storage, clock) },
+	"heap":         func(storage CacheStorage, clock Clock) Expirer { return NewHeapExpiringStorage(storage) },
+	"wheel":        func(storage CacheStorage, clock Clock) Expirer { return newWheelExpiringStorage(storage, clock) },
+}
+
+type expiryFixture struct {
+	name    string
+	storage *EventNotifierStorage
+	queue   *UpdateQueue
+	expirer Expirer
+	expired expirationCounter
+}
+
+func newExpiryFixture(name string, factory expirerFactory, queueSize int, clock Clock) *expiryFixture {
+	expired := make(expirationCounter)
+	queue := newUpdateQueue(queueSize)
+	storage := newEventNotifierStorage(newMapCacheStorage(clock), queue, expired)
+	return &expiryFixture{name, storage, queue, factory(storage, clock), expired}
+}
+
+// keys that end up expiring at soon, each one last updated by a different command
+var expiringKeys = []string{"set", "add", "replace", "cas", "append", "prepend", "incr", "touch", "readd"}
+
+// keys that must not expire
+var livingKeys = []string{"extended", "deleted"}
+
+func (self *expiryFixture) populate(soon uint32, later uint32) {
+	s := self.storage
+	s.Set("set", 0, soon, 1, []byte("a"))
+	s.Add("add", 0, soon, 1, []byte("a"))
+	s.Set("replace", 0, later, 1, []byte("a"))
+	s.Replace("replace", 0, soon, 1, []byte("b"))
+	_, entry := s.Set("cas", 0, later, 1, []byte("a"))
+	s.Cas("cas", 0, soon, 1, entry.cas_unique, []byte("b"))
+	s.Set("append", 0, soon, 1, []byte("a"))
+	s.Append("append", 1, []byte("b"))
+	s.Set("prepend", 0, soon, 1, []byte("a"))
+	s.Prepend("prepend", 1, []byte("b"))
+	s.Set("incr", 0, soon, 1, []byte("1"))
+	s.Incr("incr", 1, true)
+	s.Set("touch", 0, later, 1, []byte("a"))
+	s.Touch("touch", soon)
+	s.Set("readd", 0, later, 1, []byte("a"))
+	s.Delete("readd")
+	s.Add("readd", 0, soon, 1, []byte("a"))
+	s.Set("extended", 0, soon, 1, []byte("a"))
+	s.Touch("extended", later)
+	s.Set("deleted", 0, soon, 1, []byte("a"))
+	s.Delete("deleted")
+}
+
+func (self *expiryFixture) check(t *testing.T) {
+	for _, key := range expiringKeys {
+		if self.expired[key] != 1 {
+			t.Errorf("%s: %s expired %d times", self.name, key, self.expired[key])
+		}
+		if err, _ := self.storage.Get(key); err != KeyNotFound {
+			t.Errorf("%s: %s still present", self.name, key)
+		}
+	}
+	for _, key := range livingKeys {
+		if self.expired[key] != 0 {
+			t.Errorf("%s: %s expired %d times", self.name, key, self.expired[key])
+		}
+	}
+	if err, _ := self.storage.Get("extended"); err != Ok {
+		t.Errorf("%s: extended expired", self.name)
+	}
+}
+
+func TestItemsExpireExactlyOnce(t *testing.T) {
+	var fixtures []*expiryFixture
+	clock := newManualClock(manualStart)
+	now := uint32(clock.Seconds())
+	for name, factory := range expirerFactories {
+		// a single slot queue drops most updates, forcing the schedules to be rebuilt
+		for _, queueSize := range []int{1000, 1} {
+			fixture := newExpiryFixture(fmt.Sprintf("%s/%d", name, queueSize), factory, queueSize, clock)
+			fixture.populate(now+1, now+3600)
+			drainUpdates(fixture.expirer, fixture.queue, fixture.storage)
+			fixtures = append(fixtures, fixture)
+		}
+	}
+	clock.Advance(2e9)
+	for _, fixture := range fixtures {
+		for i := 0; i < 3; i++ {
+			expirerTick(fixture.expirer, fixture.queue, fixture.storage, clock.Seconds()+2*GenerationSize)
+		}
+		fixture.check(t)
+	}
+}
+
+// Writers racing on the same keys may queue their updates in another order than they
+// stored them, applying them all backwards is the worst case.
+func TestUpdatesOutOfOrder(t *testing.T) {
+	keys := conformanceKeys("key", 16)
+	for name, factory := range expirerFactories {
+		clock := newManualClock(manualStart)
+		soon := uint32(clock.Seconds()) + 1
+		fixture := newExpiryFixture(name, factory, 10000, clock)
+		var writers sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			writers.Add(1)
+			go func(random *rand.Rand) {
+				defer writers.Done()
+				for j := 0; j < 1000; j++ {
+					switch key := keys[random.Intn(len(keys))]; random.Intn(3) {
+					case 0:
+						fixture.storage.Set(key, 0, soon, 1, []byte("a"))
+					case 1:
+						fixture.storage.Set(key, 0, 0, 1, []byte("a"))
+					case 2:
+						fixture.storage.Delete(key)
+					}
+				}
+			}(rand.New(rand.NewSource(int64(i))))
+		}
+		writers.Wait()
+		var updates []UpdateMessage
+		for len(fixture.queue.updates) > 0 {
+			updates = append(updates, <-fixture.queue.updates)
+		}
+		for i := len(updates) - 1; i >= 0; i-- {
+			applyUpdate(fixture.expirer, fixture.storage, updates[i])
+		}
+		clock.Advance(2e9)
+		for i := 0; i < 3; i++ {
+			expirerTick(fixture.expirer, fixture.queue, fixture.storage, clock.Seconds()+2*GenerationSize)
+		}
+		fixture.storage.Iterate(func(key string, entry *StorageEntry) bool {
+			if entry.exptime != 0 {
+				t.Errorf("%s: %s never expired", name, key)
+			}
+			return true
+		})
+	}
+}
+
+func TestUpdateQueueNeverBlocks(t *testing.T) {
+	queue := newUpdateQueue(1)
+	queue.Send(UpdateMessage{Add, "foo", 0, 0})
+	queue.Send(UpdateMessage{Add, "bar", 0, 0})
+	assertEquals(t, queue.takeOverflow(), true, "overflow not flagged")
+	assertEquals(t, queue.takeOverflow(), false, "overflow flagged twice")
+}
@@ -1,58 +1,109 @@
 package expiry
 
-//This is the node for the expiry heap. We just store the absolute expiry time and a pointer to the element key.
-//Note that an entry on the heap does not guarantee that there's an entry on the storage map or that the map entry actually has expired. 
-//The invariant is:
-// Each entry in the storage map has at least one entry with the same key and ttl in the queue, or it's in the expiry channel buffer. This holds for the 'current' entry value at any given time, including updates
+import (
+	"container/heap"
+)
 
+//This is the node for the expiry heap. We store the absolute expiry time of a key and its position in the heap.
+//Note that an entry on the heap does not guarantee that there's an entry on the storage map or that the map entry actually has expired.
+//The invariant is:
+// Each key has at most one entry in the heap, holding the last exptime it was updated with.
 type Entry struct {
-	Key     *string
+	Key     string
 	Exptime uint32
+	index   int
 }
 
-// The heap is implemented in an array, hence the type is an alias of Entry slice.
-// Note that as we want to support extensible heap capacities, functions like Push and Pop may change the underlying array (Push), or re-slice (Pop). In either case, we need a slice pointer, to be able to update it as a side-effect.
-type Heap []Entry
+// heap.Interface implementation over the entries array, keeping each entry index up to date.
+// Note that as we want to support extensible heap capacities, Push and Pop may change the underlying array (Push), or re-slice (Pop), hence they're implemented on a pointer.
+type entries []*Entry
 
-//make a heap of start_size and return its pointer
-func NewHeap(start_size int) *Heap {
-	r := make(Heap, 0, start_size)
-	return &r
+func (e entries) Len() int {
+	return len(e)
 }
 
-//heap.Interface Lean() implementation
-func (h Heap) Len() int {
-	return len(h)
+// here we could also take into consideration the key as a tie resolver, but it's not significant right now
+func (e entries) Less(i, j int) bool {
+	return e[i].Exptime < e[j].Exptime
 }
 
-//heap.Interface Less() implementation 
-// here we could also take into consideration the key as a tie resolver, but it's not significant right now, as we don't care which of two entries with same exptime we want upper in the heap
-func (h Heap) Less(i, j int) bool {
-	return h[i].Exptime <= h[j].Exptime
+func (e entries) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+	e[i].index = i
+	e[j].index = j
 }
 
-// heap.Interface Swap implementation
-func (h Heap) Swap(i, j int) {
-	h[i].Exptime, h[j].Exptime = h[j].Exptime, h[i].Exptime
-	h[i].Key, h[j].Key = h[j].Key, h[i].Key
+func (e *entries) Push(ientry interface{}) {
+	entry := ientry.(*Entry)
+	entry.index = len(*e)
+	*e = append(*e, entry)
 }
 
-// heap.Interface Push implementation. Semantic is 'append'. 
-// Note that Push and Pop are implemented upon heap pointers, where Swap, Less and Len don't need pointers and are implemented on values. Recall 'the method set of the pointer type includes the method set of the value type'. May change the underlying array (and the slice)
-func (h *Heap) Push(ientry interface{}) {
-	entry := ientry.(Entry)
-	*h = append(*h, entry)
+func (e *entries) Pop() interface{} {
+	last := len(*e) - 1
+	ret := (*e)[last]
+	(*e)[last] = nil
+	*e = (*e)[:last]
+	ret.index = -1
+	return ret
 }
 
-// heap.Interface Pop implementation. Removes the last element on the heap-array. Changes the slice
-func (h *Heap) Pop() interface{} {
-	last := len(*h) - 1
-	ret := (*h)[last]
-	*h = (*h)[:last]
-	return ret
+// Priority queue of keys ordered by expiration time, indexed by key so each key is
+// queued at most once and can be updated or removed in O(log n).
+type Heap struct {
+	entries entries
+	keys    map[string]*Entry
 }
 
-func (h Heap) Tip() Entry {
-  return h[0]
+//make a heap of start_size and return its pointer
+func NewHeap(start_size int) *Heap {
+	return &Heap{make(entries, 0, start_size), make(map[string]*Entry)}
 }
 
+// Amount of queued keys
+func (h *Heap) Len() int {
+	return len(h.entries)
+}
+
+// Entry expiring first. The heap must not be empty.
+func (h *Heap) Tip() Entry {
+	return *h.entries[0]
+}
+
+// Queue key to expire at exptime, replacing its previous exptime if any
+func (h *Heap) Update(key string, exptime uint32) {
+	if entry, present := h.keys[key]; present {
+		if entry.Exptime == exptime {
+			return
+		}
+		heap.Remove(&h.entries, entry.index)
+		entry.Exptime = exptime
+		heap.Push(&h.entries, entry)
+		return
+	}
+	entry := &Entry{key, exptime, 0}
+	h.keys[key] = entry
+	heap.Push(&h.entries, entry)
+}
+
+// Drop key from the queue, returns whether it was queued
+func (h *Heap) Remove(key string) bool {
+	entry, present := h.keys[key]
+	if !present {
+		return false
+	}
+	heap.Remove(&h.entries, entry.index)
+	h.keys[key] = nil, false
+	return true
+}
+
+// Remove and return the keys whose exptime is now or earlier, in expiration order
+func (h *Heap) PopExpired(now uint32) []string {
+	var expired []string
+	for len(h.entries) > 0 && h.entries[0].Exptime <= now {
+		entry := heap.Pop(&h.entries).(*Entry)
+		h.keys[entry.Key] = nil, false
+		expired = append(expired, entry.Key)
+	}
+	return expired
+}
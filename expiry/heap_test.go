@@ -1,37 +1,76 @@
 package expiry
 
 import (
-	"container/heap"
 	"testing"
 )
 
-func TestPushPopNoExpand(t *testing.T) {
-	h := NewHeap(3)
-	heap.Push(h, Entry{10, nil})
-	heap.Push(h, Entry{1, nil})
-	heap.Push(h, Entry{5, nil})
-
-	for _, expected := range []uint32{1, 5, 10} {
-		v := heap.Pop(h).(Entry).Exptime
-		if v != expected {
-			t.Error("Not in order, expected", expected, "got", v)
+func checkPopped(t *testing.T, popped []string, expected []string) {
+	if len(popped) != len(expected) {
+		t.Error("Expected", expected, "got", popped)
+		return
+	}
+	for i, key := range expected {
+		if popped[i] != key {
+			t.Error("Not in order, expected", expected, "got", popped)
+			return
 		}
 	}
 }
 
-func TestPushPopExpand(t *testing.T) {
+func TestPopExpiredNoExpand(t *testing.T) {
 	h := NewHeap(3)
-	heap.Push(h, Entry{10, nil})
-	heap.Push(h, Entry{1, nil})
-	heap.Push(h, Entry{5, nil})
-	heap.Push(h, Entry{50, nil})
-	heap.Push(h, Entry{72, nil})
-	heap.Push(h, Entry{17, nil})
-
-	for _, expected := range []uint32{1, 5, 10, 17, 50, 72} {
-		v := heap.Pop(h).(Entry).Exptime
-		if v != expected {
-			t.Error("Not in order, expected", expected, "got", v)
-		}
+	h.Update("c", 10)
+	h.Update("a", 1)
+	h.Update("b", 5)
+
+	checkPopped(t, h.PopExpired(10), []string{"a", "b", "c"})
+	if h.Len() != 0 {
+		t.Error("Expected an empty heap, got", h.Len())
+	}
+}
+
+func TestPopExpiredExpand(t *testing.T) {
+	h := NewHeap(3)
+	h.Update("c", 10)
+	h.Update("a", 1)
+	h.Update("b", 5)
+	h.Update("e", 50)
+	h.Update("f", 72)
+	h.Update("d", 17)
+
+	checkPopped(t, h.PopExpired(0), nil)
+	checkPopped(t, h.PopExpired(17), []string{"a", "b", "c", "d"})
+	checkPopped(t, h.PopExpired(100), []string{"e", "f"})
+}
+
+func TestUpdateKeepsOneEntryPerKey(t *testing.T) {
+	h := NewHeap(3)
+	for i := uint32(0); i < 100; i++ {
+		h.Update("foo", 100-i)
+	}
+	h.Update("bar", 50)
+	h.Update("bar", 20)
+	if h.Len() != 2 {
+		t.Error("Expected one entry per key, got", h.Len())
+	}
+	if tip := h.Tip(); tip.Key != "foo" || tip.Exptime != 1 {
+		t.Error("Unexpected tip", tip.Key, tip.Exptime)
+	}
+	checkPopped(t, h.PopExpired(30), []string{"foo", "bar"})
+}
+
+func TestRemove(t *testing.T) {
+	h := NewHeap(3)
+	h.Update("a", 1)
+	h.Update("b", 2)
+	h.Update("c", 3)
+	if !h.Remove("b") {
+		t.Error("Queued key not removed")
+	}
+	if h.Remove("b") {
+		t.Error("Key removed twice")
 	}
+	checkPopped(t, h.PopExpired(3), []string{"a", "c"})
+	h.Update("b", 4)
+	checkPopped(t, h.PopExpired(4), []string{"b"})
 }
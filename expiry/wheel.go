@@ -0,0 +1,162 @@
+package expiry
+
+// Hierarchical timing wheel with one second ticks. Level i has 64 slots of 64^i seconds
+// each, so 5 levels cover 2^30 seconds ahead (farther timers are clamped into the last
+// level and cascaded down when it comes around). Timers are kept per key in doubly linked
+// slot lists, which makes Schedule, reschedule and Cancel O(1), and memory is one node per
+// scheduled key plus the fixed slots.
+const (
+	wheelBits   = 6
+	wheelSlots  = 1 << wheelBits
+	wheelMask   = wheelSlots - 1
+	wheelLevels = 5
+	wheelMax    = 1<<(wheelBits*wheelLevels) - 1
+)
+
+type wheelNode struct {
+	key        string
+	exptime    uint32
+	prev, next *wheelNode
+}
+
+// circular list sentinel
+type wheelList struct {
+	wheelNode
+}
+
+func (l *wheelList) init() {
+	l.prev, l.next = &l.wheelNode, &l.wheelNode
+}
+
+func (l *wheelList) empty() bool {
+	return l.next == &l.wheelNode
+}
+
+func (l *wheelList) push(n *wheelNode) {
+	n.prev, n.next = l.prev, &l.wheelNode
+	l.prev.next = n
+	l.prev = n
+}
+
+// move every node to another list, leaving this one empty
+func (l *wheelList) moveTo(other *wheelList) {
+	for !l.empty() {
+		n := l.next
+		unlink(n)
+		other.push(n)
+	}
+}
+
+func unlink(n *wheelNode) {
+	n.prev.next, n.next.prev = n.next, n.prev
+	n.prev, n.next = nil, nil
+}
+
+type Wheel struct {
+	current uint32 // last second processed
+	due     wheelList
+	slots   [wheelLevels][wheelSlots]wheelList
+	nodes   map[string]*wheelNode
+}
+
+// Make a wheel whose time starts at now
+func NewWheel(now uint32) *Wheel {
+	w := &Wheel{current: now, nodes: make(map[string]*wheelNode)}
+	w.due.init()
+	for level := range w.slots {
+		for slot := range w.slots[level] {
+			w.slots[level][slot].init()
+		}
+	}
+	return w
+}
+
+// Amount of scheduled keys
+func (w *Wheel) Len() int {
+	return len(w.nodes)
+}
+
+// Schedule key to expire at exptime, replacing its previous schedule if any.
+// Times already past expire on the next Advance.
+func (w *Wheel) Schedule(key string, exptime uint32) {
+	n, present := w.nodes[key]
+	if present {
+		unlink(n)
+	} else {
+		n = &wheelNode{key: key}
+		w.nodes[key] = n
+	}
+	n.exptime = exptime
+	w.place(n)
+}
+
+func (w *Wheel) Cancel(key string) {
+	if n, present := w.nodes[key]; present {
+		unlink(n)
+		w.nodes[key] = nil, false
+	}
+}
+
+// put a node in the list matching its distance from the current time
+func (w *Wheel) place(n *wheelNode) {
+	if n.exptime <= w.current {
+		w.due.push(n)
+		return
+	}
+	exptime := n.exptime
+	if exptime-w.current > wheelMax {
+		exptime = w.current + wheelMax
+	}
+	delta := exptime - w.current
+	level := 0
+	for delta >= 1<<(wheelBits*uint(level+1)) {
+		level++
+	}
+	w.slots[level][(exptime>>(wheelBits*uint(level)))&wheelMask].push(n)
+}
+
+// Move time forward up to now, calling expired for each key reaching its expiration
+// time. Keys are unscheduled before the call, so expired may schedule them again.
+// Returns the amount of keys expired.
+func (w *Wheel) Advance(now uint32, expired func(key string)) int {
+	var firing wheelList
+	firing.init()
+	w.due.moveTo(&firing)
+	count := w.fire(&firing, expired)
+	for w.current < now {
+		w.current++
+		w.cascade(1)
+		w.due.moveTo(&firing) // cascaded timers due right now
+		w.slots[0][w.current&wheelMask].moveTo(&firing)
+		count += w.fire(&firing, expired)
+	}
+	return count
+}
+
+// when the lower level wraps around, redistribute the timers of the slot now current at level
+func (w *Wheel) cascade(level int) {
+	if level >= wheelLevels || (w.current>>(wheelBits*uint(level-1)))&wheelMask != 0 {
+		return
+	}
+	w.cascade(level + 1)
+	var moving wheelList
+	moving.init()
+	w.slots[level][(w.current>>(wheelBits*uint(level)))&wheelMask].moveTo(&moving)
+	for !moving.empty() {
+		n := moving.next
+		unlink(n)
+		w.place(n)
+	}
+}
+
+func (w *Wheel) fire(firing *wheelList, expired func(key string)) int {
+	count := 0
+	for !firing.empty() {
+		n := firing.next
+		unlink(n)
+		w.nodes[n.key] = nil, false
+		expired(n.key)
+		count++
+	}
+	return count
+}
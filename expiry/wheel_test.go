@@ -0,0 +1,93 @@
+package expiry
+
+import (
+	"strconv"
+	"testing"
+)
+
+// advance the wheel one second at a time, recording when each key expires
+func advanceRecording(w *Wheel, from, to uint32) map[string]uint32 {
+	expired := make(map[string]uint32)
+	for now := from; now <= to; now++ {
+		w.Advance(now, func(key string) { expired[key] = now })
+	}
+	return expired
+}
+
+func TestWheelExpiresOnTime(t *testing.T) {
+	w := NewWheel(1000)
+	delays := []uint32{1, 2, 63, 64, 65, 100, 4095, 4096, 4097, 300000}
+	for _, delay := range delays {
+		w.Schedule(strconv.Itoa(int(delay)), 1000+delay)
+	}
+	expired := advanceRecording(w, 1001, 1000+300001)
+	for _, delay := range delays {
+		if at := expired[strconv.Itoa(int(delay))]; at != 1000+delay {
+			t.Error("Key with delay", delay, "expired at", at)
+		}
+	}
+	if w.Len() != 0 {
+		t.Error("Expected an empty wheel, got", w.Len())
+	}
+}
+
+func TestWheelReschedule(t *testing.T) {
+	w := NewWheel(0)
+	w.Schedule("foo", 10)
+	w.Schedule("foo", 100)
+	w.Schedule("bar", 100)
+	w.Schedule("bar", 5)
+	if w.Len() != 2 {
+		t.Error("Expected one schedule per key, got", w.Len())
+	}
+	expired := advanceRecording(w, 1, 200)
+	if expired["foo"] != 100 || expired["bar"] != 5 {
+		t.Error("Unexpected expirations", expired)
+	}
+}
+
+func TestWheelCancel(t *testing.T) {
+	w := NewWheel(0)
+	w.Schedule("foo", 10)
+	w.Schedule("bar", 10)
+	w.Cancel("foo")
+	count := w.Advance(20, func(key string) {
+		if key == "foo" {
+			t.Error("Cancelled key expired")
+		}
+	})
+	if count != 1 {
+		t.Error("Expected 1 expiration, got", count)
+	}
+}
+
+func TestWheelPastAndFarExptimes(t *testing.T) {
+	w := NewWheel(1000)
+	w.Schedule("past", 10)
+	w.Schedule("far", 1000+wheelMax+10)
+	if count := w.Advance(1000, func(string) {}); count != 1 {
+		t.Error("Past exptime not expired on first advance")
+	}
+	count := w.Advance(1000+wheelMax+9, func(string) {})
+	if count != 0 {
+		t.Error("Far key expired too soon")
+	}
+	if count := w.Advance(1000+wheelMax+10, func(string) {}); count != 1 {
+		t.Error("Far key not expired")
+	}
+}
+
+func TestWheelExpiredMayReschedule(t *testing.T) {
+	w := NewWheel(0)
+	w.Schedule("foo", 1)
+	fired := 0
+	w.Advance(10, func(key string) {
+		fired++
+		if fired == 1 {
+			w.Schedule(key, 5)
+		}
+	})
+	if fired != 2 {
+		t.Error("Expected the rescheduled key to expire again, fired", fired)
+	}
+}
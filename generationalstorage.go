@@ -11,21 +11,6 @@ const (
   StorageThreshold = 5000
 )
 
-var timer = func(updatesChannel chan UpdateMessage, frequency int64) {
-  for {
-    time.Sleep(1e9 * frequency) // one second * GCDelay
-    updatesChannel <- UpdateMessage{Collect, "", time.Seconds(), 0}
-  }
-}
-
-func (self *UpdateMessage) getCurrentTimeSlot() int64 {
-  return roundTime(self.currentEpoch)
-}
-
-func (self *UpdateMessage) getNewTimeSlot() int64 {
-  return roundTime(self.newEpoch)
-}
-
 func roundTime(time int64) int64 {
   return time - (time % GenerationSize) + GenerationSize
 }
@@ -47,99 +32,94 @@ func newGeneration(epoch int64) *Generation {
   return &Generation{epoch, make(map[string] bool)}
 }
 
+// Expirer keeping keys in generations of GenerationSize seconds by their expiration
+// time, a whole generation is collected at once. Keys that never expire live in a
+// permanent generation, which is evicted when more than StorageThreshold keys are tracked.
 type GenerationalStorage struct {
   generations     map[int64] *Generation
-  updatesChannel  chan UpdateMessage
+  permanent       *Generation
+  slots           map[string] int64  // generation of each tracked key, 0 for the permanent one
   cacheStorage    CacheStorage
   lastCollected   int64
-  items           uint64
 }
 
-func newGenerationalStorage(expiring_frequency int64, cacheStorage CacheStorage, updatesChannel chan UpdateMessage) *GenerationalStorage {
-  storage := &GenerationalStorage{ make(map [int64] *Generation), updatesChannel, cacheStorage, roundTime(time.Seconds()) - GenerationSize, 0 }
-  go timer(updatesChannel, expiring_frequency)
-  go processNodeChanges(storage, updatesChannel)
-  return storage;
-}
-
-func (self *GenerationalStorage) removeGenerationToCollect(now int64) *Generation {
-  if now >= self.lastCollected + GenerationSize {
-    gen := self.generations[now]
-    self.generations[now] = nil, false
-    self.lastCollected += GenerationSize
- //   logger.Printf("Updating last collected generation to %s . Generation %s", time.SecondsToUTC(self.lastCollected), gen)
-    return gen
-  }
-  return nil
+func newGenerationalStorage(cacheStorage CacheStorage, clock Clock) *GenerationalStorage {
+  return &GenerationalStorage{ make(map [int64] *Generation), newGeneration(0), make(map [string] int64), cacheStorage, roundTime(clock.Seconds()) - GenerationSize }
 }
 
 func (self *GenerationalStorage) findGeneration(timeSlot int64, createIfNotExists bool) *Generation {
   generation := self.generations[timeSlot]
   if generation == nil && createIfNotExists {
-   // logger.Printf("Creating new generation %s", time.SecondsToUTC(timeSlot))
+    logger.Debug("Creating generation", "start", time.SecondsToUTC(timeSlot).Format(time.RFC3339))
     generation = newGeneration(timeSlot)
     self.generations[timeSlot] = generation
   }
-  //logger.Printf("Returning generation %s", generation)
   return generation
 }
 
 func (self *Generation) addInhabitant(key string) {
-  //logger.Printf("Adding key %s to generation %s", key,  time.SecondsToUTC(self.startEpoch))
   self.inhabitants[key] = true
 }
 
-func processNodeChanges(storage *GenerationalStorage, channel <-chan UpdateMessage /*, ticker *time.Ticker*/) {
-  for {
-    msg := <-channel
-    switch msg.op {
-    case Add:
-    //  logger.Println("Processing Add message")
-      timeSlot := msg.getNewTimeSlot()
-      generation := storage.findGeneration(timeSlot, true)
-      //generation.addInhabitant(msg.key)
-      generation.inhabitants[msg.key] = true
-      storage.items += 1
-    case Delete:
-    //  logger.Println("Processing Delete message")
-      timeSlot := msg.getCurrentTimeSlot()
-      if generation := storage.findGeneration(timeSlot, false); generation != nil {
-        generation.inhabitants[msg.key] = false, false
-        storage.items -= 1
-      }
-    case Change:
-   //   logger.Println("Processing Change message")
-      timeSlot := msg.getCurrentTimeSlot()
-      if generation := storage.findGeneration(timeSlot, false); generation != nil {
-        generation.inhabitants[msg.key] = false, false
-      }
-      newTimeSlot := msg.getNewTimeSlot()
-      generation := storage.findGeneration(newTimeSlot, true)
-      generation.addInhabitant(msg.key)
-    case Collect:
-      logger.Println("Processing Collect message")
-      for {
-        generation := storage.removeGenerationToCollect(msg.getCurrentTimeSlot()- GenerationSize)
-        if generation == nil {
-          break
-        }
-   //     logger.Printf("Collecting generation %d", generation)
-        for key , _ := range(generation.inhabitants) {
-  //        logger.Printf("Collecting item with key %s", key)
-          storage.cacheStorage.Expire(key, false)
-          storage.items -= 1
-        }
-      }
-      if storage.items > StorageThreshold {
-        permGen := storage.findGeneration(GenerationSize, true)
-        storage.generations[GenerationSize] = nil, false
-        for key , _ := range(permGen.inhabitants) {
-          storage.cacheStorage.Expire(key, false)
-          storage.items -= 1
-        }
-        logger.Printf("Memory pressure. Collecting %d expiring items. %d items on permanent generation", storage.items)
-      }
-      logger.Printf("No more items to collect. %d Items", storage.items)
+func (self *GenerationalStorage) Schedule(key string, exptime int64) {
+  self.Unschedule(key)
+  if exptime == 0 {
+    self.permanent.addInhabitant(key)
+    self.slots[key] = 0
+    return
+  }
+  timeSlot := roundTime(exptime)
+  if timeSlot <= self.lastCollected {
+    // generations already collected won't be visited again
+    timeSlot = self.lastCollected + GenerationSize
+  }
+  self.findGeneration(timeSlot, true).addInhabitant(key)
+  self.slots[key] = timeSlot
+}
+
+func (self *GenerationalStorage) Unschedule(key string) {
+  timeSlot, present := self.slots[key]
+  if !present {
+    return
+  }
+  self.slots[key] = 0, false
+  generation := self.permanent
+  if timeSlot != 0 {
+    generation = self.findGeneration(timeSlot, false)
+  }
+  if generation != nil {
+    generation.inhabitants[key] = false, false
+  }
+}
+
+func (self *GenerationalStorage) Collect(now int64) {
+  for self.lastCollected + GenerationSize <= now {
+    self.lastCollected += GenerationSize
+    generation := self.generations[self.lastCollected]
+    if generation == nil {
+      continue
+    }
+    self.generations[self.lastCollected] = nil, false
+    logger.Debug("Collecting generation", "generation", generation, "items", len(generation.inhabitants))
+    for key , _ := range(generation.inhabitants) {
+      self.slots[key] = 0, false
+      expireOrReschedule(self, self.cacheStorage, key)
+    }
+  }
+  if len(self.slots) > StorageThreshold {
+    permGen := self.permanent
+    self.permanent = newGeneration(0)
+    for key , _ := range(permGen.inhabitants) {
+      self.slots[key] = 0, false
+      self.cacheStorage.Expire(key, false)
     }
+    logger.Info("Memory pressure, evicted non expiring items", "evicted", len(permGen.inhabitants))
   }
+  logger.Verbose("Generations collected", "scheduled", len(self.slots))
+}
+
+func (self *GenerationalStorage) Reset() {
+  self.generations = make(map [int64] *Generation)
+  self.permanent = newGeneration(0)
+  self.slots = make(map [string] int64)
 }
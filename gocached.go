@@ -1,78 +1,260 @@
 package main
 
 import (
+	"encryption"
 	"flag"
-	"log"
+	"hotkeys"
 	"net"
 	"os"
+	"strings"
 )
 
 //global logger
-var logger = log.New(os.Stdout, "gocached: ", log.Lshortfile|log.LstdFlags)
+var logger = newLogger(os.Stdout)
+
+//keys watched by clients near caches
+var watches = newWatchRegistry()
+
+//stream of updates for mutation watchers
+var mutations = newMutationStream()
+
+//cluster membership, nil unless peers were given
+var cluster *Cluster
+
+//partitioned storage, nil when partitions are disabled
+var partitioner *HashingStorage
+
+//prometheus metrics, nil unless served
+var metrics *Metrics
 
 // specific typing for base storage factory, just build a map cache storage
-func base_storage_factory() CacheStorage { return newMapCacheStorage() }
+func base_storage_factory() CacheStorage { return newMapCacheStorage(serverClock) }
 
 func main() {
 
 	// command line flags and parsing
 	var port = flag.String("port", "11212", "memcached port")
 	var storage_choice = flag.String("storage", "generational",
-		"storage implementation (generational, heap, leak)")
+		"storage implementation (generational, heap, wheel, sampling, leak)")
 	var expiring_frequency = flag.Int64("expiring-interval", 10,
-		"expiring interval in seconds")
+		"expiring interval in seconds (the wheel expires every second, sampling 10 times a second)")
 	var partitions = flag.Int("partitions", 10,
-		"storage partitions (0 or 1 to disable)")
+		"storage partitions (0 or 1 to disable), may be changed with the repartition command")
+	var peers = flag.String("peers", "",
+		"comma separated seed list of cluster members (host:port), enables clustering")
+	var advertise = flag.String("advertise", "",
+		"address announced to cluster members (defaults to 127.0.0.1:port)")
+	var hotkeys_sample = flag.Uint("hotkeys-sample", 100,
+		"sample one out of this many key accesses for hot keys detection (0 to disable)")
+	var hotkeys_top = flag.Int("hotkeys-top", 10, "amount of hot keys to report")
+	var hotkeys_interval = flag.Int64("hotkeys-interval", 60,
+		"interval in seconds after which hot keys counts are halved")
+	var hotkeys_log = flag.Bool("hotkeys-log", false,
+		"log the hot keys every hotkeys-interval")
+	var max_connections = flag.Int64("max-connections", 0,
+		"max simultaneous client connections (0 for no limit)")
+	var max_item_size = flag.Int64("max-item-size", defaultMaxItemSize,
+		"max bytes of a stored value, larger ones are refused (0 for the protocol limit, 4GB)")
+	var compress_threshold = flag.Int("compress-threshold", 0,
+		"compress stored values of at least this many bytes (0 to disable)")
+	var max_memory = flag.Int64("max-memory", 0,
+		"max megabytes of items stored, further stores fail (0 for no limit)")
+	var metrics_listen = flag.String("metrics-listen", "",
+		"address serving Prometheus metrics on /metrics, as host:port (disabled if empty)")
+	var log_verbosity = flag.Int64("verbosity", 0,
+		"log verbosity: 0 info, 1 verbose, 2 debug, 3 trace every request")
+	var v = flag.Bool("v", false, "verbose logging, same as -verbosity=1")
+	var vv = flag.Bool("vv", false, "debug logging, same as -verbosity=2")
+	var vvv = flag.Bool("vvv", false, "trace logging, same as -verbosity=3")
+	var slowlog_entries = flag.Int("slowlog-entries", 128,
+		"slow commands kept for the slowlog command (0 to disable)")
+	var slowlog_latency = flag.Int64("slowlog-latency", 10000,
+		"log commands running over this many microseconds as slow (0 to disable)")
+	var slowlog_bytes = flag.Int64("slowlog-bytes", 524288,
+		"log commands storing or retrieving values over this many bytes as slow (0 to disable)")
+	var slowlog_file = flag.String("slowlog-file", "", "file also logging slow commands")
+	var encryption_keys = flag.String("encryption-keys", "",
+		"key file encrypting the files written, like the slow log file, with AES-GCM (reloaded on SIGHUP)")
+	var decrypt = flag.String("decrypt", "",
+		"write the plaintext of a file encrypted with the encryption-keys to the standard output and exit")
+	var debug_commands = flag.Bool("debug-commands", false,
+		"enable the debug commands, like skewing the server clock, for integration tests")
+	var config = flag.String("config", "",
+		"config file, with a name = value line per flag (reloaded on SIGHUP)")
 	flag.Parse()
 
+	if *config != "" {
+		if err := loadConfig(*config); err != nil {
+			logger.Fatal("Unable to load config", "err", err)
+		}
+	}
+	maxConnections = max_connections
+	if *debug_commands {
+		debugClock = serverClock
+	}
+	maxMemory = max_memory
+	maxItemSize = max_item_size
+	*log_verbosity = verbosityLevel(*log_verbosity, *v, *vv, *vvv)
+	verbosity = log_verbosity
+	applyVerbosity()
+
+	// files written, and the one to decrypt, are encrypted with these keys
+	if *encryption_keys != "" {
+		keys, err := encryption.LoadKeyring(*encryption_keys)
+		if err != nil {
+			logger.Fatal("Unable to load the encryption keys", "err", err)
+		}
+		fileKeys = keys
+	}
+	if *decrypt != "" {
+		if fileKeys == nil {
+			logger.Fatal("Decrypting needs the encryption-keys")
+		} else if err := decryptFile(*decrypt, fileKeys, os.Stdout); err != nil {
+			logger.Fatal("Unable to decrypt", "file", *decrypt, "err", err)
+		}
+		os.Exit(0)
+	}
+	go signalHandler()
+
+	// slow log, optionally written to a file
+	if *slowlog_entries > 0 {
+		slowLog = newSlowLog(*slowlog_entries)
+		if *slowlog_file != "" {
+			if file, err := os.OpenFile(*slowlog_file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+				logger.Fatal("Unable to open the slow log file", "file", *slowlog_file, "err", err)
+			} else {
+				slowLog.out = newLogger(fileWriter(file))
+			}
+		}
+		slowLatency = slowlog_latency
+		slowBytes = slowlog_bytes
+	}
+
 	// whether using partitioned or single storage
 
 	var partition_storage CacheStorage
 	var eventful_storage CacheStorage
 
+	// the sampling storage expires entries within each partition, reporting them
+	// to the eventful storage built on top of them
+	storage_factory := base_storage_factory
+	var lazy_notifier *EventNotifierStorage
+	if *storage_choice == "sampling" {
+		storage_factory = func() CacheStorage {
+			return newLazyMapCacheStorage(serverClock, func(key string) { lazy_notifier.Expired(key) })
+		}
+	}
+
 	if *partitions > 1 {
-		partition_storage = newHashingStorage(uint32(*partitions), base_storage_factory)
+		partitioner = newHashingStorage(uint32(*partitions), storage_factory)
+		partition_storage = partitioner
 	} else {
-		partition_storage = base_storage_factory()
+		partition_storage = storage_factory()
+	}
+
+	// current partitions, they change when repartitioning
+	storage_partitions := func() []CacheStorage {
+		if partitioner != nil {
+			return partitioner.Buckets()
+		}
+		return []CacheStorage{partition_storage}
+	}
+
+	// values are compressed right above the partitions, everything else sees them
+	// as the clients do
+	value_storage := partition_storage
+	if *compress_threshold > 0 {
+		compressor = newCompressingStorage(partition_storage, *compress_threshold)
+		value_storage = compressor
 	}
 
-	// eventful storage implementation selection
+	// every update is reported to the watchers, and to the metrics if enabled
+	listeners := []UpdateListener{watches, mutations, updateLogger{}}
+	if *metrics_listen != "" {
+		metrics = newMetrics(storage_partitions)
+		listeners = append(listeners, metrics)
+		go serveMetrics(*metrics_listen)
+	}
+
+	// eventful storage implementation selection. Expirers go through the eventful
+	// storage too, so expirations reach watchers
 	switch *storage_choice {
 	case "leak":
-		logger.Print("warning, will not expire entries")
-		eventful_storage = partition_storage
+		logger.Info("Warning, will not expire entries")
+		eventful_storage = newEventNotifierStorage(value_storage, nil, listeners...)
 	case "generational":
-		updatesChannel := make(chan UpdateMessage, 5000)
-		eventful_storage = newEventNotifierStorage(partition_storage, updatesChannel)
-		newGenerationalStorage(*expiring_frequency, partition_storage, updatesChannel)
+		updates := newUpdateQueue(5000)
+		eventful_storage = newEventNotifierStorage(value_storage, updates, listeners...)
+		go runExpirer(newGenerationalStorage(eventful_storage, serverClock), updates, eventful_storage, expiring_frequency, serverClock)
 	case "heap":
-		updatesChannel := make(chan UpdateMessage, 5000)
-		eventful_storage = newEventNotifierStorage(partition_storage, updatesChannel)
-		NewHeapExpiringStorage(*expiring_frequency, partition_storage, updatesChannel)
+		updates := newUpdateQueue(5000)
+		eventful_storage = newEventNotifierStorage(value_storage, updates, listeners...)
+		go runExpirer(NewHeapExpiringStorage(eventful_storage), updates, eventful_storage, expiring_frequency, serverClock)
+	case "sampling":
+		lazy_notifier = newEventNotifierStorage(value_storage, nil, listeners...)
+		eventful_storage = lazy_notifier
+		go runExpirySampler(storage_partitions)
+	case "wheel":
+		updates := newUpdateQueue(5000)
+		eventful_storage = newEventNotifierStorage(value_storage, updates, listeners...)
+		every_second := int64(1)
+		go runExpirer(newWheelExpiringStorage(eventful_storage, serverClock), updates, eventful_storage, &every_second, serverClock)
 	}
 
+	// hot keys detection
+	if *hotkeys_sample > 0 {
+		hotKeys = hotkeys.NewTracker(uint32(*hotkeys_sample), *hotkeys_top)
+		go hotKeysDecayer(hotKeys, hotkeys_interval, hotkeys_log)
+	}
+
+	// cluster setup, the node refuses client requests until it has joined
+	if *peers != "" {
+		self := *advertise
+		if self == "" {
+			self = "127.0.0.1:" + *port
+		}
+		cluster = newCluster(self, strings.Split(*peers, ","), eventful_storage, serverClock)
+	}
+
+	// client requests go through the latency stats
+	session_storage := newLatencyStorage(eventful_storage, latencies)
+
 	// network setup
 	if addr, err := net.ResolveTCPAddr("tcp", "0.0.0.0:"+*port); err != nil {
-		logger.Fatalf("Unable to resolv local port %s\n", *port)
+		logger.Fatal("Unable to resolve local port", "port", *port)
 	} else if listener, err := net.ListenTCP("tcp", addr); err != nil {
-		logger.Fatalln("Unable to listen on requested port")
+		logger.Fatal("Unable to listen on requested port", "port", *port, "err", err)
 	} else {
-		// server loop
-		logger.Printf("Starting Gocached server")
-		for {
-			if conn, err := listener.AcceptTCP(); err != nil {
-				logger.Println("An error ocurred accepting a new connection")
-			} else {
-				go clientHandler(conn, eventful_storage)
-			}
+		if cluster != nil {
+			go cluster.Start()
 		}
+		logger.Info("Starting Gocached server", "port", *port, "storage", *storage_choice)
+		serve(listener, session_storage, serverClock)
 	}
 }
 
-func clientHandler(conn *net.TCPConn, store CacheStorage) {
+// server loop
+func serve(listener *net.TCPListener, store CacheStorage, clock Clock) {
+	for {
+		if conn, err := listener.AcceptTCP(); err != nil {
+			logger.Error("Unable to accept a new connection", "err", err)
+		} else {
+			go clientHandler(conn, store, clock)
+		}
+	}
+}
+
+func clientHandler(conn *net.TCPConn, store CacheStorage, clock Clock) {
 	defer conn.Close()
-	if session, err := NewSession(conn, store); err != nil {
-		logger.Println("An error ocurred creating a new session")
+	if !openConnection() {
+		conn.Write([]byte("SERVER_ERROR too many open connections\r\n"))
+		return
+	}
+	defer closeConnection()
+	logger.Trace("Connection opened", "client", conn.RemoteAddr())
+	defer logger.Trace("Connection closed", "client", conn.RemoteAddr())
+	if session, err := NewSession(conn, store, clock); err != nil {
+		logger.Error("Unable to create a new session", "err", err)
 	} else {
 		session.CommandLoop()
 	}
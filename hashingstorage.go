@@ -1,67 +1,318 @@
 package main
 
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
 type Hasher func(string) uint32
 
+// entries moved between buckets when resizing per lock acquisition
+const migrationBatchSize = 100
+
+// keys in a GetMulti from which buckets are read in parallel
+const parallelGetMultiKeys = 64
+
+// Partitions the keys among buckets by hash. The amount of buckets can change while
+// running: like Go maps growing, every key is moved from its old bucket when accessed,
+// while a background migration moves the rest. Resizing needs the buckets to be
+// entryMovers.
 type HashingStorage struct {
-	size           uint32
 	hasher         Hasher
+	factory        CacheStorageFactory
+	lock           sync.RWMutex // held for writing only to swap the bucket arrays
 	storageBuckets []CacheStorage
+	oldBuckets     []CacheStorage // buckets being migrated, nil unless resizing
+	moving         []sync.RWMutex // one per old bucket, held for writing while moving its entries
+	migrated       int32          // old buckets already emptied
+}
+
+// Storage whose entries can be moved to another storage as they are, without
+// notifying any update.
+type entryMover interface {
+	// Whether an entry is stored for key, expired or not
+	Holds(key string) bool
+	// Remove and return the stored entry for key, expired or not. nil when absent
+	Take(key string) *StorageEntry
+	// Store an entry as it is
+	Put(key string, entry *StorageEntry)
 }
 
 func newHashingStorage(size uint32, factory CacheStorageFactory) *HashingStorage {
-	s := &HashingStorage{size, hornerHasher, make([]CacheStorage, size)}
-	for i := uint32(0); i < size; i++ {
-		s.storageBuckets[i] = factory()
+	return &HashingStorage{hasher: hornerHasher, factory: factory, storageBuckets: newBuckets(size, factory)}
+}
+
+func newBuckets(size uint32, factory CacheStorageFactory) []CacheStorage {
+	buckets := make([]CacheStorage, size)
+	for i := range buckets {
+		buckets[i] = factory()
 	}
-	return s
+	return buckets
 }
 
 func (self *HashingStorage) Set(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (previous *StorageEntry, result *StorageEntry) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
 	return self.findBucket(key).Set(key, flags, exptime, bytes, content)
 }
 
 func (self *HashingStorage) Add(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (err ErrorCode, result *StorageEntry) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
 	return self.findBucket(key).Add(key, flags, exptime, bytes, content)
 }
 
 func (self *HashingStorage) Replace(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
 	return self.findBucket(key).Replace(key, flags, exptime, bytes, content)
 }
 
 func (self *HashingStorage) Append(key string, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
 	return self.findBucket(key).Append(key, bytes, content)
 }
 
 func (self *HashingStorage) Prepend(key string, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
 	return self.findBucket(key).Prepend(key, bytes, content)
 }
 
 func (self *HashingStorage) Cas(key string, flags uint32, exptime uint32, bytes uint32, cas_unique uint64, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
 	return self.findBucket(key).Cas(key, flags, exptime, bytes, cas_unique, content)
 }
 
 func (self *HashingStorage) Get(key string) (ErrorCode, *StorageEntry) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
 	return self.findBucket(key).Get(key)
 }
 
+func (self *HashingStorage) Peek(key string) (ErrorCode, *StorageEntry) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.findBucket(key).Peek(key)
+}
+
+// Replace the value of key as the server rewrites it, for buckets that are valueRewriters
+func (self *HashingStorage) Rewrite(key string, bytes uint32, cas_unique uint64, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.findBucket(key).(valueRewriter).Rewrite(key, bytes, cas_unique, content)
+}
+
+// Every bucket is read once for all of its keys, in parallel for large batches. While
+// resizing, keys are read one by one as they may need to be moved first.
+func (self *HashingStorage) GetMulti(keys []string) []*StorageEntry {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	entries := make([]*StorageEntry, len(keys))
+	if self.oldBuckets != nil {
+		for i, key := range keys {
+			_, entries[i] = self.findBucket(key).Get(key)
+		}
+		return entries
+	}
+	// positions of the keys of each bucket
+	positions := make(map[uint32][]int)
+	for i, key := range keys {
+		bucket := self.hasher(key) % uint32(len(self.storageBuckets))
+		positions[bucket] = append(positions[bucket], i)
+	}
+	var readers sync.WaitGroup
+	for bucket, indexes := range positions {
+		read := func(bucket uint32, indexes []int) {
+			bucketKeys := make([]string, len(indexes))
+			for i, index := range indexes {
+				bucketKeys[i] = keys[index]
+			}
+			for i, entry := range self.storageBuckets[bucket].GetMulti(bucketKeys) {
+				entries[indexes[i]] = entry
+			}
+		}
+		if len(keys) < parallelGetMultiKeys || len(positions) == 1 {
+			read(bucket, indexes)
+			continue
+		}
+		readers.Add(1)
+		go func(bucket uint32, indexes []int) {
+			defer readers.Done()
+			read(bucket, indexes)
+		}(bucket, indexes)
+	}
+	readers.Wait()
+	return entries
+}
+
 func (self *HashingStorage) Delete(key string) (ErrorCode, *StorageEntry) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
 	return self.findBucket(key).Delete(key)
 }
 
+func (self *HashingStorage) CasDelete(key string, cas_unique uint64) (ErrorCode, *StorageEntry) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.findBucket(key).CasDelete(key, cas_unique)
+}
+
 func (self *HashingStorage) Incr(key string, value uint64, incr bool) (ErrorCode, *StorageEntry, *StorageEntry) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
 	return self.findBucket(key).Incr(key, value, incr)
 }
 
-func (self *HashingStorage) Expire(key string, check bool) {
-	self.findBucket(key).Expire(key, check)
+func (self *HashingStorage) Touch(key string, exptime uint32) (ErrorCode, *StorageEntry, *StorageEntry) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.findBucket(key).Touch(key, exptime)
+}
+
+func (self *HashingStorage) Expire(key string, check bool) bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.findBucket(key).Expire(key, check)
+}
+
+func (self *HashingStorage) Iterate(visitor EntryVisitor) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	// no entry moves while iterating, so each one is visited once
+	for i := range self.moving {
+		self.moving[i].RLock()
+		defer self.moving[i].RUnlock()
+	}
+	stopped := false
+	for _, bucket := range self.buckets() {
+		bucket.Iterate(func(key string, entry *StorageEntry) bool {
+			stopped = !visitor(key, entry)
+			return !stopped
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// Every bucket, including the ones still being migrated when resizing
+func (self *HashingStorage) Buckets() []CacheStorage {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.buckets()
+}
+
+func (self *HashingStorage) buckets() []CacheStorage {
+	buckets := make([]CacheStorage, 0, len(self.storageBuckets)+len(self.oldBuckets))
+	buckets = append(buckets, self.oldBuckets...)
+	return append(buckets, self.storageBuckets...)
 }
 
+// Bucket for key, moving its entry there first when resizing. Must be called with
+// the lock held for reading. Keys already moved only wait for the moves from their
+// old bucket.
 func (self *HashingStorage) findBucket(key string) CacheStorage {
-	storageIndex := self.hasher(key) % self.size
-	storage := self.storageBuckets[storageIndex]
+	hash := self.hasher(key)
+	storage := self.storageBuckets[hash%uint32(len(self.storageBuckets))]
+	if self.oldBuckets != nil {
+		index := hash % uint32(len(self.oldBuckets))
+		old, moving := self.oldBuckets[index], &self.moving[index]
+		moving.RLock()
+		held := old.(entryMover).Holds(key)
+		moving.RUnlock()
+		if held {
+			moving.Lock()
+			moveEntry(key, old, storage)
+			moving.Unlock()
+		}
+	}
 	return storage
 }
 
+func moveEntry(key string, from CacheStorage, to CacheStorage) {
+	if entry := from.(entryMover).Take(key); entry != nil {
+		to.(entryMover).Put(key, entry)
+	}
+}
+
+// Start moving every entry to size new buckets, fails if the previous resize is
+// still migrating
+func (self *HashingStorage) Resize(size uint32) os.Error {
+	if size == 0 {
+		return os.NewError("at least one partition is needed")
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.oldBuckets != nil {
+		return os.NewError("previous resize still migrating")
+	}
+	for _, bucket := range self.storageBuckets {
+		if _, movable := bucket.(entryMover); !movable {
+			return os.NewError("partitions can't be migrated")
+		}
+	}
+	self.oldBuckets = self.storageBuckets
+	self.storageBuckets = newBuckets(size, self.factory)
+	self.moving = make([]sync.RWMutex, len(self.oldBuckets))
+	self.migrated = 0
+	logger.Info("Resizing partitions", "from", len(self.oldBuckets), "to", size)
+	go self.migrate()
+	return nil
+}
+
+// Amount of buckets, and when resizing, the amount of old buckets and how many of
+// them were migrated
+func (self *HashingStorage) Size() (size int, old int, migrated int) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return len(self.storageBuckets), len(self.oldBuckets), int(atomic.AddInt32(&self.migrated, 0))
+}
+
+// Empty the old buckets a batch at a time, letting requests go on in between
+func (self *HashingStorage) migrate() {
+	for done := false; !done; {
+		done = self.migrateBatch()
+	}
+	self.lock.Lock()
+	self.oldBuckets, self.moving = nil, nil
+	size := len(self.storageBuckets)
+	self.lock.Unlock()
+	logger.Info("Partitions resized", "partitions", size)
+}
+
+// move up to migrationBatchSize entries, returns whether every old bucket is empty
+func (self *HashingStorage) migrateBatch() bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for index := int(atomic.AddInt32(&self.migrated, 0)); index < len(self.oldBuckets); index++ {
+		if self.moveBatch(index) {
+			return false
+		}
+		atomic.AddInt32(&self.migrated, 1)
+	}
+	return true
+}
+
+// move up to migrationBatchSize entries out of an old bucket, returns whether any moved
+func (self *HashingStorage) moveBatch(index int) bool {
+	self.moving[index].Lock()
+	defer self.moving[index].Unlock()
+	var keys []string
+	self.oldBuckets[index].Iterate(func(key string, entry *StorageEntry) bool {
+		keys = append(keys, key)
+		return len(keys) < migrationBatchSize
+	})
+	for _, key := range keys {
+		to := self.storageBuckets[self.hasher(key)%uint32(len(self.storageBuckets))]
+		moveEntry(key, self.oldBuckets[index], to)
+	}
+	return len(keys) > 0
+}
+
 var hornerHasher = func(value string) uint32 {
 	var hashcode uint32 = 1
 	for i := 0; i < len(value); i++ {
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// virtual nodes per member, smooths the key distribution among members
+const ringReplicas = 100
+
+type ringPoint struct {
+	hash   uint32
+	member string
+}
+
+type ringPoints []ringPoint
+
+func (p ringPoints) Len() int           { return len(p) }
+func (p ringPoints) Less(i, j int) bool { return p[i].hash < p[j].hash }
+func (p ringPoints) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Consistent hash ring. The ring only depends on the member set, so every node
+// knowing the same members agrees on the owner of every key.
+type HashRing struct {
+	points  ringPoints
+	members []string
+}
+
+func newHashRing(members []string) *HashRing {
+	ring := &HashRing{make(ringPoints, 0, len(members)*ringReplicas), make([]string, len(members))}
+	copy(ring.members, members)
+	sort.Strings(ring.members)
+	for _, member := range ring.members {
+		for i := 0; i < ringReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(member + "-" + strconv.Itoa(i)))
+			ring.points = append(ring.points, ringPoint{hash, member})
+		}
+	}
+	sort.Sort(ring.points)
+	return ring
+}
+
+// Member owning the given key, or "" if the ring is empty
+func (self *HashRing) Owner(key string) string {
+	if len(self.points) == 0 {
+		return ""
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(self.points), func(i int) bool { return self.points[i].hash >= hash })
+	if i == len(self.points) {
+		i = 0
+	}
+	return self.points[i].member
+}
+
+// Sorted member list
+func (self *HashRing) Members() []string {
+	return self.members
+}
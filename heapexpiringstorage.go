@@ -2,73 +2,52 @@ package main
 
 import (
 	"expiry"
-	"time"
-	"container/heap"
 )
 
-//Implements a CacheStorage interface with entry expiration.
+//Implements an Expirer keeping exptimes in a heap, ordered by expiration. Each key is queued once, with its latest exptime.
 type HeapExpiringStorage struct {
   CacheStorage
-  updatesChannel  chan UpdateMessage
 	heap *expiry.Heap
 }
 
-func (hs *HeapExpiringStorage) ProcessUpdates() {
-  for {
-    msg := <-hs.updatesChannel
-    switch msg.op {
-    case Add, Change:
-      hs.AddEntry(expiry.Entry{&msg.key, uint32(msg.newEpoch)}, uint32(msg.currentEpoch))
-    case Collect:
-      logger.Println("Collecting expired entries")
-      hs.Collect(uint32(msg.currentEpoch))
-    }
-  }
+//Update. Given an exptime update, queues the key at its new exptime, replacing the previous one
+func (hs *HeapExpiringStorage) Schedule(key string, exptime int64) {
+	if exptime == 0 {
+		hs.heap.Remove(key)
+	} else {
+		hs.heap.Update(key, uint32(exptime))
+	}
 }
 
-//Update. Given an exptime update, stores a new entry in a exptime ordered heap
-func (hs *HeapExpiringStorage) AddEntry(entry expiry.Entry, now uint32) {
-	if entry.Exptime > now {
-		heap.Push(hs.heap, entry)
-	}
+func (hs *HeapExpiringStorage) Unschedule(key string) {
+	hs.heap.Remove(key)
 }
 
-// Inspects the exptime heap for candidates for expiration, and dispatches to storage.Expire. The heap won't contain any expired entry refs(*) when it exits
-func (hs *HeapExpiringStorage) Collect(now uint32) {
-	h := hs.heap
-	if h.Len() == 0 {
-		return
-	}
-	logger.Printf("heap size: %v", h.Len())
-	for h.Len() > 0 {
-		tip := h.Tip()
-		if tip.Exptime > now {
-			break
+// Pops the due keys from the exptime heap, and dispatches to storage.Expire. The heap won't contain any expired key when it exits
+func (hs *HeapExpiringStorage) Collect(now int64) {
+	expired := 0
+	for _, key := range hs.heap.PopExpired(uint32(now)) {
+		if expireOrReschedule(hs, hs.CacheStorage, key) {
+			expired += 1
 		}
-		h.Pop()
-		logger.Println("trying to expire %s at %v", *tip.Key, now)
-		hs.CacheStorage.Expire(*tip.Key, true)
+	}
+	if expired > 0 {
+		logger.Verbose("Heap collected", "expired", expired, "scheduled", hs.heap.Len())
 	}
 }
 
+func (hs *HeapExpiringStorage) Reset() {
+	hs.heap = expiry.NewHeap(100) //TODO, size as config parameter
+}
+
 //Allocate a new HeapExpiringStorage and Initialize it
-func NewHeapExpiringStorage(collect_frequency int64, cacheStorage CacheStorage, updatesChannel chan UpdateMessage) *HeapExpiringStorage {
-  hs := &HeapExpiringStorage{cacheStorage, updatesChannel, nil}
-  hs.Init(collect_frequency)
+func NewHeapExpiringStorage(cacheStorage CacheStorage) *HeapExpiringStorage {
+  hs := &HeapExpiringStorage{cacheStorage, nil}
+  hs.Init()
   return hs
 }
 //Init an allocated HeapExpiringStorage
-func (hs *HeapExpiringStorage) Init(collect_frequency int64) {
-	logger.Println("init heap notify storage")
-	hs.heap = expiry.NewHeap(100) //TODO, size as config parameter
-	go hs.CollectTicker(collect_frequency)
-  go hs.ProcessUpdates()
+func (hs *HeapExpiringStorage) Init() {
+	logger.Debug("Init heap expiring storage")
+	hs.Reset()
 }
-
-func (hs *HeapExpiringStorage) CollectTicker(collect_frequency int64){
-  for {
-    time.Sleep(1e9 * collect_frequency)
-    hs.updatesChannel  <- UpdateMessage{Collect, "", time.Seconds(), 0}
-  }
-}
-
@@ -0,0 +1,62 @@
+package hotkeys
+
+// Count-min sketch. Estimates the frequency of a key using a fixed amount of memory,
+// never underestimating it. Each row uses a different hash, derived from a 64 bit FNV-1a
+// hash of the key (h1 + row * h2), and the estimate is the minimum counter among rows.
+type CountMinSketch struct {
+	width  uint32
+	counts [][]uint32
+}
+
+func NewCountMinSketch(depth int, width uint32) *CountMinSketch {
+	s := &CountMinSketch{width, make([][]uint32, depth)}
+	for i := range s.counts {
+		s.counts[i] = make([]uint32, width)
+	}
+	return s
+}
+
+// FNV-1a on the string itself, avoids a []byte conversion per sample
+func hash(key string) (uint32, uint32) {
+	var h uint64 = 14695981039346656037
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return uint32(h), uint32(h >> 32)
+}
+
+// Count n more occurrences of key, returns the new estimate for it
+func (self *CountMinSketch) Add(key string, n uint32) uint32 {
+	h1, h2 := hash(key)
+	var min uint32
+	for row, counts := range self.counts {
+		i := (h1 + uint32(row)*h2) % self.width
+		counts[i] += n
+		if row == 0 || counts[i] < min {
+			min = counts[i]
+		}
+	}
+	return min
+}
+
+func (self *CountMinSketch) Estimate(key string) uint32 {
+	h1, h2 := hash(key)
+	var min uint32
+	for row, counts := range self.counts {
+		i := (h1 + uint32(row)*h2) % self.width
+		if row == 0 || counts[i] < min {
+			min = counts[i]
+		}
+	}
+	return min
+}
+
+// Halve every counter, so old traffic fades away
+func (self *CountMinSketch) Decay() {
+	for _, counts := range self.counts {
+		for i := range counts {
+			counts[i] >>= 1
+		}
+	}
+}
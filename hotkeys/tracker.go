@@ -0,0 +1,113 @@
+package hotkeys
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	sketchDepth = 4
+	sketchWidth = 4096
+)
+
+type Item struct {
+	Key   string
+	Count uint64
+}
+
+type Items []Item
+
+func (items Items) Len() int           { return len(items) }
+func (items Items) Less(i, j int) bool { return items[i].Count > items[j].Count }
+func (items Items) Swap(i, j int)      { items[i], items[j] = items[j], items[i] }
+
+// The k keys with the highest estimates seen so far. k is meant to be small, so the
+// candidates are kept in a plain slice.
+type TopK struct {
+	k     int
+	items Items
+}
+
+func NewTopK(k int) *TopK {
+	return &TopK{k, make(Items, 0, k)}
+}
+
+// Offer a key with its current estimate, it replaces the least frequent candidate when full.
+func (self *TopK) Offer(key string, count uint64) {
+	min := -1
+	for i := range self.items {
+		if self.items[i].Key == key {
+			self.items[i].Count = count
+			return
+		}
+		if min < 0 || self.items[i].Count < self.items[min].Count {
+			min = i
+		}
+	}
+	if len(self.items) < self.k {
+		self.items = append(self.items, Item{key, count})
+	} else if min >= 0 && self.items[min].Count < count {
+		self.items[min] = Item{key, count}
+	}
+}
+
+// Candidates sorted by descending count
+func (self *TopK) Items() Items {
+	items := make(Items, len(self.items))
+	copy(items, self.items)
+	sort.Sort(items)
+	return items
+}
+
+func (self *TopK) Decay() {
+	for i := range self.items {
+		self.items[i].Count >>= 1
+	}
+}
+
+// Sampling heavy hitters tracker. Only one out of rate accesses is counted, and the
+// sampling decision is taken without locking, so it's cheap enough to leave on.
+type Tracker struct {
+	rate   uint32
+	ticks  uint32
+	mutex  sync.Mutex
+	sketch *CountMinSketch
+	top    *TopK
+}
+
+func NewTracker(rate uint32, k int) *Tracker {
+	if rate == 0 {
+		rate = 1
+	}
+	return &Tracker{rate: rate, sketch: NewCountMinSketch(sketchDepth, sketchWidth), top: NewTopK(k)}
+}
+
+// Register an access to key
+func (self *Tracker) Sample(key string) {
+	if atomic.AddUint32(&self.ticks, 1)%self.rate != 0 {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.top.Offer(key, uint64(self.sketch.Add(key, 1)))
+}
+
+// Hottest keys, with their estimated access count scaled by the sample rate
+func (self *Tracker) Top() Items {
+	self.mutex.Lock()
+	items := self.top.Items()
+	self.mutex.Unlock()
+	for i := range items {
+		items[i].Count *= uint64(self.rate)
+	}
+	return items
+}
+
+// Halve all counts, so the tracker reflects recent traffic
+func (self *Tracker) Decay() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.sketch.Decay()
+	self.top.Decay()
+}
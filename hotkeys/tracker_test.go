@@ -0,0 +1,63 @@
+package hotkeys
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestSketchNeverUnderestimates(t *testing.T) {
+	s := NewCountMinSketch(4, 64)
+	for i := 0; i < 1000; i++ {
+		s.Add("key"+strconv.Itoa(i%100), 1)
+	}
+	for i := 0; i < 100; i++ {
+		if e := s.Estimate("key" + strconv.Itoa(i)); e < 10 {
+			t.Error("Underestimated key", i, "got", e)
+		}
+	}
+}
+
+func TestSketchDecay(t *testing.T) {
+	s := NewCountMinSketch(4, 64)
+	s.Add("foo", 10)
+	s.Decay()
+	if e := s.Estimate("foo"); e != 5 {
+		t.Error("Expected 5 after decay, got", e)
+	}
+}
+
+func TestTopKKeepsMostFrequent(t *testing.T) {
+	top := NewTopK(2)
+	top.Offer("a", 1)
+	top.Offer("b", 5)
+	top.Offer("c", 3)
+	top.Offer("a", 2)
+	items := top.Items()
+	if len(items) != 2 || items[0].Key != "b" || items[1].Key != "c" {
+		t.Error("Unexpected top items", items)
+	}
+}
+
+func TestTrackerFindsHotKey(t *testing.T) {
+	tracker := NewTracker(1, 3)
+	for i := 0; i < 10000; i++ {
+		tracker.Sample("cold" + strconv.Itoa(i))
+		if i%2 == 0 {
+			tracker.Sample("hot")
+		}
+	}
+	items := tracker.Top()
+	if len(items) == 0 || items[0].Key != "hot" || items[0].Count < 5000 {
+		t.Error("Hot key not detected", items)
+	}
+}
+
+func TestTrackerScalesSampledCounts(t *testing.T) {
+	tracker := NewTracker(10, 1)
+	for i := 0; i < 1000; i++ {
+		tracker.Sample("hot")
+	}
+	if items := tracker.Top(); len(items) != 1 || items[0].Count != 1000 {
+		t.Error("Expected a scaled count of 1000, got", items)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"hotkeys"
+	"strings"
+	"time"
+)
+
+//heavy hitters tracker, nil when disabled
+var hotKeys *hotkeys.Tracker
+
+// register a key access on the hot keys tracker, if enabled
+func sampleHotKey(key string) {
+	if hotKeys != nil {
+		hotKeys.Sample(key)
+	}
+}
+
+// every interval seconds, optionally log the hottest keys and halve their counts so
+// the tracker follows the current traffic. Both are runtime settings.
+func hotKeysDecayer(tracker *hotkeys.Tracker, interval *int64, log *bool) {
+	for {
+		time.Sleep(1e9 * settingInt64(interval))
+		if settingBool(log) {
+			top := make([]string, 0)
+			for _, item := range tracker.Top() {
+				top = append(top, fmt.Sprintf("%s:%d", item.Key, item.Count))
+			}
+			logger.Info("Hot keys", "keys", strings.Join(top, ","))
+		}
+		tracker.Decay()
+	}
+}
@@ -0,0 +1,114 @@
+package latency
+
+import (
+	"sync/atomic"
+)
+
+const (
+	subBucketBits = 5 // 32 sub buckets for every power of two, within 3% of the recorded values
+	subBuckets    = 1 << subBucketBits
+	Highest       = 1<<36 - 1 // highest value tracked, about a minute in nanoseconds
+)
+
+// bucket for values up to Highest, they are grouped by power of two and every group is
+// split in subBuckets linear buckets. Values under 2*subBuckets have a bucket each.
+func bucket(value uint64) int {
+	if value < 2*subBuckets {
+		return int(value)
+	}
+	shift := uint(0)
+	for value>>shift >= 2*subBuckets {
+		shift++
+	}
+	return int(shift)*subBuckets + int(value>>shift)
+}
+
+// highest value in a bucket
+func bucketHighest(index int) uint64 {
+	if index < 2*subBuckets {
+		return uint64(index)
+	}
+	shift := uint(index/subBuckets - 1)
+	return (uint64(index-int(shift)*subBuckets)+1)<<shift - 1
+}
+
+// High dynamic range histogram, with a bounded relative error and a fixed size. Values
+// are recorded and read concurrently, a reading is not a consistent snapshot though.
+type Histogram struct {
+	counts []uint64
+	count  uint64
+	sum    uint64
+	max    uint64
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make([]uint64, bucket(Highest)+1)}
+}
+
+// Record a value, those over Highest are recorded as Highest
+func (self *Histogram) Record(value int64) {
+	v := uint64(Highest)
+	if value < 0 {
+		v = 0
+	} else if value < Highest {
+		v = uint64(value)
+	}
+	atomic.AddUint64(&self.counts[bucket(v)], 1)
+	atomic.AddUint64(&self.count, 1)
+	atomic.AddUint64(&self.sum, v)
+	for {
+		max := atomic.AddUint64(&self.max, 0)
+		if v <= max || atomic.CompareAndSwapUint64(&self.max, max, v) {
+			return
+		}
+	}
+}
+
+func (self *Histogram) Count() uint64 {
+	return atomic.AddUint64(&self.count, 0)
+}
+
+// Sum of the recorded values
+func (self *Histogram) Sum() uint64 {
+	return atomic.AddUint64(&self.sum, 0)
+}
+
+func (self *Histogram) Max() int64 {
+	return int64(atomic.AddUint64(&self.max, 0))
+}
+
+// Value under which percentile (0 to 100) of the recorded values are, 0 if none was recorded
+func (self *Histogram) Percentile(percentile float64) int64 {
+	count := self.Count()
+	if count == 0 {
+		return 0
+	}
+	target := uint64(percentile/100*float64(count) + 0.5)
+	if target == 0 {
+		target = 1
+	}
+	seen := uint64(0)
+	for i := range self.counts {
+		if seen += atomic.AddUint64(&self.counts[i], 0); seen >= target {
+			if highest := bucketHighest(i); highest < uint64(self.Max()) {
+				return int64(highest)
+			}
+			return self.Max()
+		}
+	}
+	return self.Max()
+}
+
+// Forget every recorded value. Values recorded meanwhile may be kept.
+func (self *Histogram) Reset() {
+	for i := range self.counts {
+		subtract(&self.counts[i])
+	}
+	subtract(&self.count)
+	subtract(&self.sum)
+	subtract(&self.max)
+}
+
+func subtract(value *uint64) {
+	atomic.AddUint64(value, -atomic.AddUint64(value, 0))
+}
@@ -0,0 +1,58 @@
+package latency
+
+import (
+	"testing"
+)
+
+func TestBuckets(t *testing.T) {
+	previous := -1
+	for value := uint64(0); value < 1<<20; value++ {
+		b := bucket(value)
+		if b != previous && b != previous+1 {
+			t.Fatal("Buckets not contiguous at", value)
+		}
+		if value > bucketHighest(b) || b > 0 && value <= bucketHighest(b-1) {
+			t.Fatal("Value", value, "out of bucket", b)
+		}
+		previous = b
+	}
+	if bucketHighest(bucket(Highest)) != Highest {
+		t.Error("Highest value not at the end of its bucket")
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	h := NewHistogram()
+	for i := int64(1); i <= 10000; i++ {
+		h.Record(i * 1000)
+	}
+	for _, c := range []struct {
+		percentile float64
+		value      int64
+	}{{50, 5000000}, {90, 9000000}, {99, 9900000}, {100, 10000000}} {
+		v := h.Percentile(c.percentile)
+		if v < c.value || float64(v) > float64(c.value)*1.04 {
+			t.Error("Percentile", c.percentile, "expected about", c.value, "got", v)
+		}
+	}
+	if h.Count() != 10000 || h.Max() != 10000000 || h.Sum() != 50005000000 {
+		t.Error("Bad count, max or sum", h.Count(), h.Max(), h.Sum())
+	}
+}
+
+func TestOutOfRangeAndReset(t *testing.T) {
+	h := NewHistogram()
+	h.Record(-5)
+	h.Record(Highest * 2)
+	if h.Percentile(50) != 0 || h.Percentile(100) != Highest {
+		t.Error("Out of range values not clamped", h.Percentile(50), h.Percentile(100))
+	}
+	h.Reset()
+	if h.Count() != 0 || h.Max() != 0 || h.Sum() != 0 || h.Percentile(99) != 0 {
+		t.Error("Values kept after reset")
+	}
+	h.Record(7)
+	if h.Percentile(50) != 7 {
+		t.Error("Expected 7 after reset, got", h.Percentile(50))
+	}
+}
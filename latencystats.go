@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"latency"
+	"strings"
+	"time"
+)
+
+// latency classes of the recorded commands
+var latencyClasses = []string{"get", "set", "delete", "incr", "touch", "cas"}
+
+// class of every recorded command
+var commandClasses = map[string]string{
+	"get": "get", "gets": "get",
+	"set": "set", "add": "set", "replace": "set", "append": "set", "prepend": "set",
+	"delete": "delete",
+	"incr":   "incr", "decr": "incr",
+	"touch": "touch",
+	"cas":   "cas",
+}
+
+// percentiles reported by stats latency and the metrics
+var latencyPercentiles = []float64{50, 90, 99, 99.9}
+
+// Latency histograms by class, of the whole commands and of their storage calls alone
+type LatencyStats struct {
+	commands map[string]*latency.Histogram
+	storage  map[string]*latency.Histogram
+}
+
+func newLatencyStats() *LatencyStats {
+	stats := &LatencyStats{make(map[string]*latency.Histogram), make(map[string]*latency.Histogram)}
+	for _, class := range latencyClasses {
+		stats.commands[class] = latency.NewHistogram()
+		stats.storage[class] = latency.NewHistogram()
+	}
+	return stats
+}
+
+var latencies = newLatencyStats()
+
+// Record the Exec time of a command, in nanoseconds
+func recordLatency(name string, elapsed int64) {
+	if class, present := commandClasses[name]; present {
+		latencies.commands[class].Record(elapsed)
+	}
+}
+
+func (self *LatencyStats) Reset() {
+	for _, class := range latencyClasses {
+		self.commands[class].Reset()
+		self.storage[class].Reset()
+	}
+}
+
+// Write every histogram as stats lines, in microseconds
+func (self *LatencyStats) writeStats(w io.Writer) {
+	for _, kind := range []string{"command", "storage"} {
+		histograms := self.commands
+		if kind == "storage" {
+			histograms = self.storage
+		}
+		for _, class := range latencyClasses {
+			h := histograms[class]
+			prefix := kind + "_" + class
+			fmt.Fprintf(w, "STAT %s_count %d\r\n", prefix, h.Count())
+			for _, p := range latencyPercentiles {
+				fmt.Fprintf(w, "STAT %s_p%s_us %d\r\n", prefix, percentileName(p), h.Percentile(p)/1e3)
+			}
+			fmt.Fprintf(w, "STAT %s_max_us %d\r\n", prefix, h.Max()/1e3)
+		}
+	}
+}
+
+// Write every histogram as Prometheus summaries, in seconds
+func (self *LatencyStats) expose(w io.Writer) {
+	for _, kind := range []string{"command", "storage"} {
+		histograms := self.commands
+		if kind == "storage" {
+			histograms = self.storage
+		}
+		name := "gocached_" + kind + "_latency_seconds"
+		header(w, name, "summary", "Latency of the "+kind+" calls, by class.")
+		for _, class := range latencyClasses {
+			h := histograms[class]
+			for _, p := range latencyPercentiles {
+				fmt.Fprintf(w, "%s{class=%q,quantile=\"%g\"} %g\n", name, class, p/100, float64(h.Percentile(p))/1e9)
+			}
+			fmt.Fprintf(w, "%s_sum{class=%q} %g\n", name, class, float64(h.Sum())/1e9)
+			fmt.Fprintf(w, "%s_count{class=%q} %d\n", name, class, h.Count())
+		}
+	}
+}
+
+// 99.9 is p999
+func percentileName(p float64) string {
+	return strings.Replace(fmt.Sprintf("%g", p), ".", "", -1)
+}
+
+// Storage recording how long every call takes, by latency class
+type LatencyStorage struct {
+	CacheStorage
+	stats *LatencyStats
+}
+
+func newLatencyStorage(storage CacheStorage, stats *LatencyStats) *LatencyStorage {
+	return &LatencyStorage{storage, stats}
+}
+
+func (self *LatencyStorage) record(class string, start int64) {
+	self.stats.storage[class].Record(time.Nanoseconds() - start)
+}
+
+func (self *LatencyStorage) Set(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (previous *StorageEntry, result *StorageEntry) {
+	defer self.record("set", time.Nanoseconds())
+	return self.CacheStorage.Set(key, flags, exptime, bytes, content)
+}
+
+func (self *LatencyStorage) Add(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (err ErrorCode, result *StorageEntry) {
+	defer self.record("set", time.Nanoseconds())
+	return self.CacheStorage.Add(key, flags, exptime, bytes, content)
+}
+
+func (self *LatencyStorage) Replace(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (err ErrorCode, previous *StorageEntry, result *StorageEntry) {
+	defer self.record("set", time.Nanoseconds())
+	return self.CacheStorage.Replace(key, flags, exptime, bytes, content)
+}
+
+func (self *LatencyStorage) Append(key string, bytes uint32, content []byte) (err ErrorCode, previous *StorageEntry, result *StorageEntry) {
+	defer self.record("set", time.Nanoseconds())
+	return self.CacheStorage.Append(key, bytes, content)
+}
+
+func (self *LatencyStorage) Prepend(key string, bytes uint32, content []byte) (err ErrorCode, previous *StorageEntry, result *StorageEntry) {
+	defer self.record("set", time.Nanoseconds())
+	return self.CacheStorage.Prepend(key, bytes, content)
+}
+
+func (self *LatencyStorage) Cas(key string, flags uint32, exptime uint32, bytes uint32, cas_unique uint64, content []byte) (err ErrorCode, previous *StorageEntry, result *StorageEntry) {
+	defer self.record("cas", time.Nanoseconds())
+	return self.CacheStorage.Cas(key, flags, exptime, bytes, cas_unique, content)
+}
+
+func (self *LatencyStorage) Get(key string) (err ErrorCode, result *StorageEntry) {
+	defer self.record("get", time.Nanoseconds())
+	return self.CacheStorage.Get(key)
+}
+
+func (self *LatencyStorage) GetMulti(keys []string) []*StorageEntry {
+	defer self.record("get", time.Nanoseconds())
+	return self.CacheStorage.GetMulti(keys)
+}
+
+func (self *LatencyStorage) Delete(key string) (err ErrorCode, deleted *StorageEntry) {
+	defer self.record("delete", time.Nanoseconds())
+	return self.CacheStorage.Delete(key)
+}
+
+func (self *LatencyStorage) CasDelete(key string, cas_unique uint64) (err ErrorCode, deleted *StorageEntry) {
+	defer self.record("delete", time.Nanoseconds())
+	return self.CacheStorage.CasDelete(key, cas_unique)
+}
+
+func (self *LatencyStorage) Incr(key string, value uint64, incr bool) (err ErrorCode, previous *StorageEntry, result *StorageEntry) {
+	defer self.record("incr", time.Nanoseconds())
+	return self.CacheStorage.Incr(key, value, incr)
+}
+
+func (self *LatencyStorage) Touch(key string, exptime uint32) (err ErrorCode, previous *StorageEntry, result *StorageEntry) {
+	defer self.record("touch", time.Nanoseconds())
+	return self.CacheStorage.Touch(key, exptime)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Verbosity levels, matching memcached -v, -vv and -vvv
+const (
+	LogInfo    = iota // always logged: errors, startup and configuration or membership changes
+	LogVerbose        // periodic activity, like expirer collections
+	LogDebug          // internal state transitions, like each key expired
+	LogTrace          // every client request
+)
+
+var levelNames = []string{LogInfo: "info", LogVerbose: "verbose", LogDebug: "debug", LogTrace: "trace"}
+
+// Leveled logger writing logfmt lines: a message and key value pairs, like
+//   ts=2011-10-19T09:00:00Z level=info caller=gocached.go:42 msg="Starting server" port=11212
+type Logger struct {
+	level int32
+	lock  sync.Mutex
+	out   io.Writer
+}
+
+func newLogger(out io.Writer) *Logger {
+	return &Logger{out: out}
+}
+
+// Change the level, clamped to the known ones
+func (self *Logger) SetLevel(level int) {
+	if level < LogInfo {
+		level = LogInfo
+	} else if level > LogTrace {
+		level = LogTrace
+	}
+	for {
+		current := atomic.AddInt32(&self.level, 0)
+		if atomic.CompareAndSwapInt32(&self.level, current, int32(level)) {
+			return
+		}
+	}
+}
+
+func (self *Logger) Level() int {
+	return int(atomic.AddInt32(&self.level, 0))
+}
+
+// Whether messages of level are logged, to skip building costly fields
+func (self *Logger) Enabled(level int) bool {
+	return level <= self.Level()
+}
+
+func (self *Logger) Error(msg string, fields ...interface{}) {
+	self.log(LogInfo, "error", msg, fields)
+}
+
+func (self *Logger) Info(msg string, fields ...interface{}) {
+	self.log(LogInfo, levelNames[LogInfo], msg, fields)
+}
+
+func (self *Logger) Verbose(msg string, fields ...interface{}) {
+	self.log(LogVerbose, levelNames[LogVerbose], msg, fields)
+}
+
+func (self *Logger) Debug(msg string, fields ...interface{}) {
+	self.log(LogDebug, levelNames[LogDebug], msg, fields)
+}
+
+func (self *Logger) Trace(msg string, fields ...interface{}) {
+	self.log(LogTrace, levelNames[LogTrace], msg, fields)
+}
+
+// Log an error and exit
+func (self *Logger) Fatal(msg string, fields ...interface{}) {
+	self.log(LogInfo, "fatal", msg, fields)
+	os.Exit(1)
+}
+
+func (self *Logger) log(level int, name string, msg string, fields []interface{}) {
+	if !self.Enabled(level) {
+		return
+	}
+	var line bytes.Buffer
+	line.WriteString("ts=" + time.UTC().Format(time.RFC3339) + " level=" + name)
+	if _, file, number, ok := runtime.Caller(2); ok {
+		line.WriteString(" caller=" + path.Base(file) + ":" + strconv.Itoa(number))
+	}
+	line.WriteString(" msg=" + logfmtValue(msg))
+	for i := 0; i < len(fields); i += 2 {
+		line.WriteString(" " + fmt.Sprint(fields[i]) + "=")
+		if i+1 < len(fields) {
+			line.WriteString(logfmtValue(fmt.Sprint(fields[i+1])))
+		}
+	}
+	line.WriteString("\n")
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.out.Write(line.Bytes())
+}
+
+// quote values that would break the key=value pairs
+func logfmtValue(value string) string {
+	if value == "" || strings.IndexAny(value, " =\"\t\r\n") >= 0 {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// verbosity flag, nil when not set up (as in tests)
+var verbosity *int64
+
+// Set the logger level from the verbosity flag
+func applyVerbosity() {
+	if verbosity != nil {
+		logger.SetLevel(int(settingInt64(verbosity)))
+	}
+}
+
+// Apply the -v, -vv and -vvv shorthands over the verbosity flag
+func verbosityLevel(verbosity int64, v bool, vv bool, vvv bool) int64 {
+	for level, set := range []bool{LogVerbose: v, LogDebug: vv, LogTrace: vvv} {
+		if set && int64(level) > verbosity {
+			verbosity = int64(level)
+		}
+	}
+	return verbosity
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	var out bytes.Buffer
+	log := newLogger(&out)
+	log.Info("shown")
+	log.Verbose("hidden")
+	log.SetLevel(LogDebug)
+	log.Debug("shown")
+	log.Trace("hidden")
+	assertEquals(t, strings.Count(out.String(), "\n"), 2, "logged lines")
+	assertEquals(t, strings.Count(out.String(), "hidden"), 0, "lines over the level")
+
+	log.SetLevel(7)
+	assertEquals(t, log.Level(), LogTrace, "clamped level")
+	log.SetLevel(-1)
+	assertEquals(t, log.Level(), LogInfo, "clamped level")
+}
+
+func TestLoggerFormat(t *testing.T) {
+	var out bytes.Buffer
+	log := newLogger(&out)
+	log.Error("Unable to join", "member", "peer:11212", "err", "connection refused", "empty", "")
+	line := out.String()
+	if !strings.HasPrefix(line, "ts=") || !strings.HasSuffix(line, "\n") {
+		t.Errorf("bad line %q", line)
+	}
+	for _, field := range []string{" level=error ", " caller=logger_test.go:", ` msg="Unable to join" `,
+		" member=peer:11212 ", ` err="connection refused" `, ` empty=""`} {
+		if !strings.Contains(line, field) {
+			t.Errorf("%q missing in %q", field, line)
+		}
+	}
+}
+
+func TestVerbosityLevel(t *testing.T) {
+	assertEquals(t, verbosityLevel(0, false, false, false), int64(LogInfo), "no flags")
+	assertEquals(t, verbosityLevel(0, true, false, false), int64(LogVerbose), "-v")
+	assertEquals(t, verbosityLevel(0, true, true, false), int64(LogDebug), "-vv")
+	assertEquals(t, verbosityLevel(1, false, false, true), int64(LogTrace), "-vvv")
+	assertEquals(t, verbosityLevel(2, true, false, false), int64(LogDebug), "verbosity over -v")
+}
@@ -0,0 +1,107 @@
+package lz
+
+import (
+	"os"
+)
+
+// Byte oriented LZ77 compression, far cheaper than deflate for the short values of a
+// cache: a Compressor only needs a table of recent positions, reused between values,
+// and repetitive values such as json still shrink several times.
+//
+// A block is a series of runs, each starting with a control byte. Below 0x80 it's
+// followed by that many plus one literal bytes. Otherwise its low 7 bits plus minMatch
+// are the length of a copy of the output written before, at the distance given by the
+// next two big endian bytes. Copies may overlap the bytes they write.
+const (
+	minMatch    = 4
+	maxMatch    = minMatch + 0x7f
+	maxLiterals = 0x80
+	maxDistance = 1<<16 - 1
+	tableBits   = 12
+)
+
+var ErrCorrupt = os.NewError("lz: corrupt block")
+
+// Keeps the last position of each hashed 4 bytes sequence. Positions are stored plus
+// an offset that grows with every block, so the ones left by previous blocks are told
+// apart without clearing the table. Not safe for concurrent use.
+type Compressor struct {
+	table  [1 << tableBits]int32
+	offset int32
+}
+
+func hash(b []byte) uint32 {
+	return (uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24) * 2654435761 >> (32 - tableBits)
+}
+
+// Append the compressed block of src to dst
+func (self *Compressor) Compress(dst []byte, src []byte) []byte {
+	if self.offset > 1<<30 {
+		self.table, self.offset = [1 << tableBits]int32{}, 0
+	}
+	literals := 0 // start of the bytes not written yet
+	for i := 0; i+minMatch <= len(src); {
+		h := hash(src[i:])
+		candidate := int(self.table[h] - self.offset)
+		self.table[h] = self.offset + int32(i)
+		if candidate < 0 || candidate >= i || i-candidate > maxDistance || src[candidate] != src[i] || src[candidate+1] != src[i+1] ||
+			src[candidate+2] != src[i+2] || src[candidate+3] != src[i+3] {
+			i++
+			continue
+		}
+		dst = appendLiterals(dst, src[literals:i])
+		length := minMatch
+		for length < maxMatch && i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		distance := i - candidate
+		dst = append(dst, byte(0x80|(length-minMatch)), byte(distance>>8), byte(distance))
+		i += length
+		literals = i
+	}
+	self.offset += int32(len(src))
+	return appendLiterals(dst, src[literals:])
+}
+
+func appendLiterals(dst []byte, literals []byte) []byte {
+	for len(literals) > 0 {
+		n := len(literals)
+		if n > maxLiterals {
+			n = maxLiterals
+		}
+		dst = append(append(dst, byte(n-1)), literals[:n]...)
+		literals = literals[n:]
+	}
+	return dst
+}
+
+// Append the bytes a compressed block stands for to dst
+func Decompress(dst []byte, src []byte) ([]byte, os.Error) {
+	start := len(dst) // copies can't reach before the block
+	for i := 0; i < len(src); {
+		control := int(src[i])
+		i++
+		if control < 0x80 {
+			n := control + 1
+			if i+n > len(src) {
+				return dst, ErrCorrupt
+			}
+			dst = append(dst, src[i:i+n]...)
+			i += n
+			continue
+		}
+		if i+2 > len(src) {
+			return dst, ErrCorrupt
+		}
+		length, distance := control-0x80+minMatch, int(src[i])<<8|int(src[i+1])
+		i += 2
+		if distance == 0 || distance > len(dst)-start {
+			return dst, ErrCorrupt
+		}
+		for from := len(dst) - distance; length > 0; length-- {
+			dst = append(dst, dst[from])
+			from++
+		}
+	}
+	return dst, nil
+}
@@ -0,0 +1,57 @@
+package lz
+
+import (
+	"bytes"
+	"rand"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, 1000)
+	for i := range random {
+		random[i] = byte(rand.Intn(256))
+	}
+	// repeated further than a copy can reach
+	far := append(append(append([]byte{}, random...), make([]byte, maxDistance)...), random...)
+	values := [][]byte{
+		[]byte{},
+		[]byte("abc"),
+		[]byte("abcd"),
+		[]byte(strings.Repeat("a", 1000)),
+		[]byte(strings.Repeat(`{"id": 1, "name": "some name", "tags": ["a", "b"]}`, 20)),
+		random,
+		far,
+	}
+	// one compressor for every value, as they are reused
+	compressor := new(Compressor)
+	for i, value := range values {
+		compressed := compressor.Compress([]byte("prefix"), value)
+		if !bytes.HasPrefix(compressed, []byte("prefix")) {
+			t.Errorf("%d: dst not appended to", i)
+		}
+		decompressed, err := Decompress([]byte("prefix"), compressed[6:])
+		if err != nil || !bytes.Equal(decompressed[6:], value) {
+			t.Errorf("%d: got back %d bytes out of %d, %v", i, len(decompressed)-6, len(value), err)
+		}
+	}
+}
+
+func TestCompressesRepetitions(t *testing.T) {
+	json := []byte(strings.Repeat(`{"id": 1, "name": "some name", "tags": ["a", "b"]}`, 20))
+	compressed := new(Compressor).Compress(nil, json)
+	if len(compressed) > len(json)/10 {
+		t.Errorf("Compressed %d bytes to %d", len(json), len(compressed))
+	}
+	if decompressed, err := Decompress(nil, compressed); err != nil || !bytes.Equal(decompressed, json) {
+		t.Errorf("Got back %d bytes out of %d, %v", len(decompressed), len(json), err)
+	}
+}
+
+func TestCorruptBlocks(t *testing.T) {
+	for _, block := range [][]byte{{0x05, 'a'}, {0x80, 0}, {0x00, 'a', 0x80, 0, 2}, {0x00, 'a', 0x80, 0, 0}} {
+		if _, err := Decompress(nil, block); err != ErrCorrupt {
+			t.Errorf("%v: expected corrupt, got %v", block, err)
+		}
+	}
+}
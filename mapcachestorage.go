@@ -1,18 +1,49 @@
 package main
 
 import (
+	"rand"
 	"strconv"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
+// approximate size of the items in every MapCacheStorage, keys and data
+var storedBytes int64
+
+func entrySize(key string, entry *StorageEntry) int64 {
+	return int64(len(key) + len(entry.content))
+}
+
+// last cas unique assigned, shared by every MapCacheStorage so values never repeat,
+// even for a key deleted and stored again
+var lastCas uint64
+
+// cas unique for a new or modified entry
+func nextCas() uint64 {
+	return atomic.AddUint64(&lastCas, 1)
+}
+
 type MapCacheStorage struct {
 	storageMap map[string]*StorageEntry
 	rwLock     sync.RWMutex
+	clock      Clock // telling when entries expire and are accessed
+	// lazy expiration, only set when built with newLazyMapCacheStorage
+	onExpired func(key string) // called with the lock held for every entry expired here
+	keys      []string         // every stored key, to pick random samples from
+	positions map[string]int   // index of each key in keys
+	bytes     int64            // approximate size of the items, as storedBytes
 }
 
-func newMapCacheStorage() *MapCacheStorage {
-	storage := &MapCacheStorage{}
+func newMapCacheStorage(clock Clock) *MapCacheStorage {
+	storage := &MapCacheStorage{clock: clock}
+	storage.Init()
+	return storage
+}
+
+// A storage removing expired entries by itself, when they're accessed or sampled by
+// ExpireSample, reporting each removal to onExpired.
+func newLazyMapCacheStorage(clock Clock, onExpired func(key string)) *MapCacheStorage {
+	storage := &MapCacheStorage{clock: clock, onExpired: onExpired, positions: make(map[string]int)}
 	storage.Init()
 	return storage
 }
@@ -21,48 +52,140 @@ func (self *MapCacheStorage) Init() {
 	self.storageMap = make(map[string]*StorageEntry)
 }
 
-func (self *StorageEntry) expired() bool {
-	if self.exptime == 0 {
-		return false
+func (self *MapCacheStorage) now() uint32 {
+	return uint32(self.clock.Seconds())
+}
+
+// stored entry for key if it didn't expire. Expired entries are removed when lazy,
+// so it must be called with the write lock held.
+func (self *MapCacheStorage) live(key string) (*StorageEntry, bool) {
+	entry, present := self.storageMap[key]
+	if !present {
+		return nil, false
+	}
+	if entry.expired(self.now()) {
+		if self.onExpired != nil {
+			self.remove(key)
+			self.onExpired(key)
+		}
+		return nil, false
+	}
+	return entry, true
+}
+
+func (self *MapCacheStorage) store(key string, entry *StorageEntry) {
+	size := entrySize(key, entry)
+	if previous, present := self.storageMap[key]; present {
+		size -= entrySize(key, previous)
+	} else if self.positions != nil {
+		self.positions[key] = len(self.keys)
+		self.keys = append(self.keys, key)
+	}
+	atomic.AddInt64(&storedBytes, size)
+	self.bytes += size
+	self.storageMap[key] = entry
+}
+
+func (self *MapCacheStorage) remove(key string) {
+	size := entrySize(key, self.storageMap[key])
+	atomic.AddInt64(&storedBytes, -size)
+	self.bytes -= size
+	self.storageMap[key] = nullStorageEntry, false
+	if self.positions == nil {
+		return
 	}
-	now := uint32(time.Seconds())
-	return self.exptime <= now
+	// move the last key to the removed one position
+	position := self.positions[key]
+	last := len(self.keys) - 1
+	self.keys[position] = self.keys[last]
+	self.positions[self.keys[position]] = position
+	self.keys = self.keys[:last]
+	self.positions[key] = 0, false
+}
+
+// access of an item stored now
+func storedAccess(now uint32) ItemAccess {
+	return ItemAccess{created: now, accessed: now, previous: now}
+}
+
+// access of the entry once its value is rewritten now, as appending does. It keeps
+// counting the fetches since the item was stored.
+func (self *StorageEntry) writtenAccess(now uint32) ItemAccess {
+	access := self.accessInfo()
+	access.previous, access.accessed, access.fetched = access.accessed, now, 0
+	return access
+}
+
+// access of the entry once touched now, which doesn't change its value
+func (self *StorageEntry) touchedAccess(now uint32) ItemAccess {
+	access := self.accessInfo()
+	access.previous, access.accessed = access.accessed, now
+	return access
+}
+
+// Record a fetch of the entry at now. Concurrent fetches may leave previous at the
+// time of either of them, which is close enough.
+func (self *StorageEntry) fetch(now uint32) {
+	atomic.AddUint32(&self.access.fetches, 1)
+	atomic.AddUint32(&self.access.fetched, 1)
+	accessed := atomic.AddUint32(&self.access.accessed, 0)
+	if atomic.CompareAndSwapUint32(&self.access.accessed, accessed, now) {
+		for previous := atomic.AddUint32(&self.access.previous, 0); !atomic.CompareAndSwapUint32(&self.access.previous, previous, accessed); {
+			previous = atomic.AddUint32(&self.access.previous, 0)
+		}
+	}
+}
+
+// Current access of the entry
+func (self *StorageEntry) accessInfo() ItemAccess {
+	return ItemAccess{
+		created:  atomic.AddUint32(&self.access.created, 0),
+		accessed: atomic.AddUint32(&self.access.accessed, 0),
+		previous: atomic.AddUint32(&self.access.previous, 0),
+		fetches:  atomic.AddUint32(&self.access.fetches, 0),
+		fetched:  atomic.AddUint32(&self.access.fetched, 0),
+	}
+}
+
+// whether the entry expired at now
+func (self *StorageEntry) expired(now uint32) bool {
+	return self.exptime != 0 && self.exptime <= now
 }
 
 func (self *MapCacheStorage) Set(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (previous *StorageEntry, result *StorageEntry) {
 	self.rwLock.Lock()
 	defer self.rwLock.Unlock()
-	entry, present := self.storageMap[key]
+	entry, present := self.live(key)
 	var newEntry *StorageEntry
-	if present && !entry.expired() {
-		newEntry = &StorageEntry{exptime, flags, bytes, entry.cas_unique + 1, content}
-		self.storageMap[key] = newEntry
+	if present {
+		newEntry = &StorageEntry{exptime, flags, bytes, nextCas(), content, storedAccess(self.now())}
+		self.store(key, newEntry)
 		return entry, newEntry
 	}
-	newEntry = &StorageEntry{exptime, flags, bytes, 0, content}
-	self.storageMap[key] = newEntry
+	newEntry = &StorageEntry{exptime, flags, bytes, nextCas(), content, storedAccess(self.now())}
+	self.store(key, newEntry)
 	return nil, newEntry
 }
 
 func (self *MapCacheStorage) Add(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (err ErrorCode, result *StorageEntry) {
 	self.rwLock.Lock()
 	defer self.rwLock.Unlock()
-	entry, present := self.storageMap[key]
-	if present && !entry.expired() {
+	entry, present := self.live(key)
+	if present {
 		return KeyAlreadyInUse, nil
 	}
-	entry = &StorageEntry{exptime, flags, bytes, 0, content}
-	self.storageMap[key] = entry
+	entry = &StorageEntry{exptime, flags, bytes, nextCas(), content, storedAccess(self.now())}
+	self.store(key, entry)
 	return Ok, entry
 }
 
 func (self *MapCacheStorage) Replace(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
 	self.rwLock.Lock()
 	defer self.rwLock.Unlock()
-	entry, present := self.storageMap[key]
-	if present && !entry.expired() {
-		newEntry := &StorageEntry{exptime, flags, bytes, entry.cas_unique + 1, content}
-		self.storageMap[key] = newEntry
+	entry, present := self.live(key)
+	if present {
+		newEntry := &StorageEntry{exptime, flags, bytes, nextCas(), content, storedAccess(self.now())}
+		self.store(key, newEntry)
 		return Ok, entry, newEntry
 	}
 	return KeyNotFound, nil, nil
@@ -71,13 +194,16 @@ func (self *MapCacheStorage) Replace(key string, flags uint32, exptime uint32, b
 func (self *MapCacheStorage) Append(key string, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
 	self.rwLock.Lock()
 	defer self.rwLock.Unlock()
-	entry, present := self.storageMap[key]
-	if present && !entry.expired() {
+	entry, present := self.live(key)
+	if present {
+		if outgrows(entry.content, content) {
+			return TooLarge, entry, nil
+		}
 		newContent := make([]byte, len(entry.content)+len(content))
 		copy(newContent, entry.content)
 		copy(newContent[len(entry.content):], content)
-		newEntry := &StorageEntry{entry.exptime, entry.flags, bytes + entry.bytes, entry.cas_unique + 1, newContent}
-		self.storageMap[key] = newEntry
+		newEntry := &StorageEntry{entry.exptime, entry.flags, bytes + entry.bytes, nextCas(), newContent, entry.writtenAccess(self.now())}
+		self.store(key, newEntry)
 		return Ok, entry, newEntry
 	}
 	return KeyNotFound, nil, nil
@@ -86,27 +212,35 @@ func (self *MapCacheStorage) Append(key string, bytes uint32, content []byte) (E
 func (self *MapCacheStorage) Prepend(key string, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
 	self.rwLock.Lock()
 	defer self.rwLock.Unlock()
-	entry, present := self.storageMap[key]
-	if present && !entry.expired() {
+	entry, present := self.live(key)
+	if present {
+		if outgrows(entry.content, content) {
+			return TooLarge, entry, nil
+		}
 		newContent := make([]byte, len(entry.content)+len(content))
 		copy(newContent, content)
 		copy(newContent[len(content):], entry.content)
 		newEntry := &StorageEntry{entry.exptime, entry.flags, bytes + entry.bytes,
-			entry.cas_unique + 1, newContent}
-		self.storageMap[key] = newEntry
+			nextCas(), newContent, entry.writtenAccess(self.now())}
+		self.store(key, newEntry)
 		return Ok, entry, newEntry
 	}
 	return KeyNotFound, nil, nil
 }
 
+// whether appending or prepending content to value makes it larger than an item may be
+func outgrows(value []byte, content []byte) bool {
+	return uint64(len(value))+uint64(len(content)) > maxItemBytes()
+}
+
 func (self *MapCacheStorage) Cas(key string, flags uint32, exptime uint32, bytes uint32, cas_unique uint64, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
 	self.rwLock.Lock()
 	defer self.rwLock.Unlock()
-	entry, present := self.storageMap[key]
-	if present && !entry.expired() {
+	entry, present := self.live(key)
+	if present {
 		if entry.cas_unique == cas_unique {
-			newEntry := &StorageEntry{exptime, flags, bytes, cas_unique, content}
-			self.storageMap[key] = newEntry
+			newEntry := &StorageEntry{exptime, flags, bytes, nextCas(), content, storedAccess(self.now())}
+			self.store(key, newEntry)
 			return Ok, entry, newEntry
 		} else {
 			return IllegalParameter, entry, nil
@@ -115,32 +249,108 @@ func (self *MapCacheStorage) Cas(key string, flags uint32, exptime uint32, bytes
 	return KeyNotFound, nil, nil
 }
 
+// Replace the value of key as the server rewrites it, but only if it didn't change
+// since fetched with cas_unique. The item keeps its flags, expiration time and access.
+func (self *MapCacheStorage) Rewrite(key string, bytes uint32, cas_unique uint64, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+	self.rwLock.Lock()
+	defer self.rwLock.Unlock()
+	entry, present := self.live(key)
+	if !present {
+		return KeyNotFound, nil, nil
+	} else if entry.cas_unique != cas_unique {
+		return IllegalParameter, entry, nil
+	}
+	newEntry := &StorageEntry{entry.exptime, entry.flags, bytes, nextCas(), content, entry.writtenAccess(self.now())}
+	self.store(key, newEntry)
+	return Ok, entry, newEntry
+}
+
 func (self *MapCacheStorage) Get(key string) (ErrorCode, *StorageEntry) {
+	return self.get(key, true)
+}
+
+func (self *MapCacheStorage) Peek(key string) (ErrorCode, *StorageEntry) {
+	return self.get(key, false)
+}
+
+// stored entry for key if it didn't expire, recording a fetch of it when fetching
+func (self *MapCacheStorage) get(key string, fetching bool) (ErrorCode, *StorageEntry) {
 	self.rwLock.RLock()
-	defer self.rwLock.RUnlock()
 	entry, present := self.storageMap[key]
-	if present && !entry.expired() {
-		return Ok, entry
+	self.rwLock.RUnlock()
+	if !present {
+		return KeyNotFound, nil
 	}
-	return KeyNotFound, nil
+	now := self.now()
+	if entry.expired(now) {
+		if self.onExpired != nil {
+			self.rwLock.Lock()
+			self.live(key)
+			self.rwLock.Unlock()
+		}
+		return KeyNotFound, nil
+	}
+	if fetching {
+		entry.fetch(now)
+	}
+	return Ok, entry
+}
+
+func (self *MapCacheStorage) GetMulti(keys []string) []*StorageEntry {
+	entries := make([]*StorageEntry, len(keys))
+	expired := false
+	now := self.now()
+	self.rwLock.RLock()
+	for i, key := range keys {
+		if entry, present := self.storageMap[key]; present && !entry.expired(now) {
+			entry.fetch(now)
+			entries[i] = entry
+		} else if present {
+			expired = true
+		}
+	}
+	self.rwLock.RUnlock()
+	if expired && self.onExpired != nil {
+		self.rwLock.Lock()
+		for i, key := range keys {
+			if entries[i] == nil {
+				self.live(key)
+			}
+		}
+		self.rwLock.Unlock()
+	}
+	return entries
 }
 
 func (self *MapCacheStorage) Delete(key string) (ErrorCode, *StorageEntry) {
 	self.rwLock.Lock()
 	defer self.rwLock.Unlock()
-	entry, present := self.storageMap[key]
-	if present && !entry.expired() {
-		self.storageMap[key] = nil, false
+	entry, present := self.live(key)
+	if present {
+		self.remove(key)
 		return Ok, entry
 	}
 	return KeyNotFound, nil
 }
 
+func (self *MapCacheStorage) CasDelete(key string, cas_unique uint64) (ErrorCode, *StorageEntry) {
+	self.rwLock.Lock()
+	defer self.rwLock.Unlock()
+	entry, present := self.live(key)
+	if !present {
+		return KeyNotFound, nil
+	} else if entry.cas_unique != cas_unique {
+		return IllegalParameter, nil
+	}
+	self.remove(key)
+	return Ok, entry
+}
+
 func (self *MapCacheStorage) Incr(key string, value uint64, incr bool) (ErrorCode, *StorageEntry, *StorageEntry) {
 	self.rwLock.Lock()
 	defer self.rwLock.Unlock()
-	entry, present := self.storageMap[key]
-	if present && !entry.expired() {
+	entry, present := self.live(key)
+	if present {
 		if addValue, err := strconv.Atoui64(string(entry.content)); err == nil {
 			var incrValue uint64
 			if incr {
@@ -150,12 +360,11 @@ func (self *MapCacheStorage) Incr(key string, value uint64, incr bool) (ErrorCod
 			} else {
 				incrValue = uint64(addValue) - value
 			}
-			incrStrValue := strconv.Uitoa64(incrValue)
-			old_value := entry.content
-			entry.content = []byte(incrStrValue)
-			entry.bytes = uint32(len(entry.content))
-			entry.cas_unique += 1
-			return Ok, &StorageEntry{entry.exptime, entry.flags, entry.bytes, entry.cas_unique, old_value}, entry
+			// a new entry, as readers may hold the current one
+			incrContent := []byte(strconv.Uitoa64(incrValue))
+			newEntry := &StorageEntry{entry.exptime, entry.flags, uint32(len(incrContent)), nextCas(), incrContent, entry.writtenAccess(self.now())}
+			self.store(key, newEntry)
+			return Ok, entry, newEntry
 		} else {
 			return IllegalParameter, nil, nil
 		}
@@ -163,14 +372,83 @@ func (self *MapCacheStorage) Incr(key string, value uint64, incr bool) (ErrorCod
 	return KeyNotFound, nil, nil
 }
 
+func (self *MapCacheStorage) Touch(key string, exptime uint32) (ErrorCode, *StorageEntry, *StorageEntry) {
+	self.rwLock.Lock()
+	defer self.rwLock.Unlock()
+	entry, present := self.live(key)
+	if present {
+		newEntry := &StorageEntry{exptime, entry.flags, entry.bytes, nextCas(), entry.content, entry.touchedAccess(self.now())}
+		self.store(key, newEntry)
+		return Ok, entry, newEntry
+	}
+	return KeyNotFound, nil, nil
+}
+
 /* keep a null object for map deletion */
 var nullStorageEntry = &StorageEntry{}
 
-func (self *MapCacheStorage) Expire(key string, check bool) {
+func (self *MapCacheStorage) Expire(key string, check bool) bool {
 	self.rwLock.Lock()
 	defer self.rwLock.Unlock()
 	entry, present := self.storageMap[key]
-	if present && (!check || entry.expired()) {
-		self.storageMap[key] = nullStorageEntry, false
+	if present && (!check || entry.expired(self.now())) {
+		self.remove(key)
+		return true
+	}
+	return false
+}
+
+func (self *MapCacheStorage) Holds(key string) bool {
+	self.rwLock.RLock()
+	defer self.rwLock.RUnlock()
+	_, present := self.storageMap[key]
+	return present
+}
+
+func (self *MapCacheStorage) Take(key string) *StorageEntry {
+	self.rwLock.Lock()
+	defer self.rwLock.Unlock()
+	entry, present := self.storageMap[key]
+	if !present {
+		return nil
+	}
+	self.remove(key)
+	return entry
+}
+
+func (self *MapCacheStorage) Put(key string, entry *StorageEntry) {
+	self.rwLock.Lock()
+	defer self.rwLock.Unlock()
+	self.store(key, entry)
+}
+
+// Amount of items stored, expired ones not removed yet included, and their approximate size
+func (self *MapCacheStorage) Stats() (items int, bytes int64) {
+	self.rwLock.RLock()
+	defer self.rwLock.RUnlock()
+	return len(self.storageMap), self.bytes
+}
+
+func (self *MapCacheStorage) Iterate(visitor EntryVisitor) {
+	self.rwLock.RLock()
+	defer self.rwLock.RUnlock()
+	for key, entry := range self.storageMap {
+		if !visitor(key, entry) {
+			return
+		}
+	}
+}
+
+// Remove the expired entries among count randomly picked keys, for storages built
+// with newLazyMapCacheStorage. Returns the amount of keys sampled and expired.
+func (self *MapCacheStorage) ExpireSample(count int) (sampled int, expired int) {
+	self.rwLock.Lock()
+	defer self.rwLock.Unlock()
+	for ; sampled < count && len(self.keys) > 0; sampled++ {
+		key := self.keys[rand.Intn(len(self.keys))]
+		if _, present := self.live(key); !present {
+			expired += 1
+		}
 	}
+	return sampled, expired
 }
@@ -7,106 +7,135 @@ import (
 
 func TestSetAndGet(t *testing.T) {
 
-  storage := newMapStorage()
+  storage := newMapCacheStorage(serverClock)
 
-  storage.Set("foo", 0, 60, 5, []byte("babab"))
-  flag, bytes, _, content, err := storage.Get("foo")
+  storage.Set("foo", 0, 0, 5, []byte("babab"))
+  err, entry := storage.Get("foo")
 
-  assertEquals(t, int(flag), 0, "invalid flag")
-  assertEquals(t, int(bytes), 5, "invalid byte lenght")
-  assertEquals(t, string(content), "babab", "invalid content")
-  assertEquals(t, err, nil, "Invalid err ")
+  assertEquals(t, int(entry.flags), 0, "invalid flag")
+  assertEquals(t, int(entry.bytes), 5, "invalid byte lenght")
+  assertEquals(t, string(entry.content), "babab", "invalid content")
+  assertEquals(t, int(err), Ok, "Invalid err ")
 }
 
 func TestSetShouldUpdateCas(t *testing.T) {
 
-  storage := newMapStorage()
+  storage := newMapCacheStorage(serverClock)
 
-  storage.Set("foo", 0, 60, 5, []byte("aaaaa"))
-  _, _, cas_before, _, _ := storage.Get("foo")
-  storage.Set("foo", 0, 60, 5, []byte("bbbbb"))
-  _, _, cas_after, _, _ := storage.Get("foo")
+  storage.Set("foo", 0, 0, 5, []byte("aaaaa"))
+  _, before := storage.Get("foo")
+  storage.Set("foo", 0, 0, 5, []byte("bbbbb"))
+  _, after := storage.Get("foo")
 
-  assertNotEquals(t, cas_before, cas_after, "Invalid cas update")
+  assertNotEquals(t, before.cas_unique, after.cas_unique, "Invalid cas update")
 
 }
 
 
 func TestAddShouldFailIfKeyAlreadyExists(t *testing.T) {
 
-  storage := newMapStorage()
+  storage := newMapCacheStorage(serverClock)
 
-  storage.Set("foo", 0, 60, 5, []byte("aaaaa"))
-  err := storage.Add("foo", 1, 30, 4, []byte("bbbb"))
+  storage.Set("foo", 0, 0, 5, []byte("aaaaa"))
+  err, _ := storage.Add("foo", 1, 0, 4, []byte("bbbb"))
 
-  assertNotEquals(t, err, nil, "failed to add")
+  assertNotEquals(t, int(err), Ok, "failed to add")
 }
 
 func TestAddShouldAddIfNotExists(t *testing.T) {
 
-  storage := newMapStorage()
+  storage := newMapCacheStorage(serverClock)
 
-  storage.Set("foo", 0, 60, 5, []byte("aaaaa"))
-  err := storage.Add("bar", 1, 30, 4, []byte("bbbb"))
+  storage.Set("foo", 0, 0, 5, []byte("aaaaa"))
+  err, _ := storage.Add("bar", 1, 0, 4, []byte("bbbb"))
 
-  assertEquals(t, err, nil, "failed to add")
+  assertEquals(t, int(err), Ok, "failed to add")
 }
 
 
 func TestShouldReplaceIfExists(t *testing.T) {
 
-  storage := newMapStorage()
+  storage := newMapCacheStorage(serverClock)
   
-  storage.Set("foo", 0, 60, 5, []byte("aaaaa"))
-  err := storage.Replace("foo", 1, 120, 4, []byte("bbbb"))
+  storage.Set("foo", 0, 0, 5, []byte("aaaaa"))
+  storage.Replace("foo", 1, 0, 4, []byte("bbbb"))
 
-  flag, bytes, _, content, err := storage.Get("foo") 
+  err, entry := storage.Get("foo")
 
-  assertEquals(t, int(flag), 1, "invalid flag")
-  assertEquals(t, int(bytes), 4, "invalid byte lenght")
-  assertEquals(t, string(content), "bbbb", "invalid content")
-  assertEquals(t, err, nil, "Invalid err ")
+  assertEquals(t, int(entry.flags), 1, "invalid flag")
+  assertEquals(t, int(entry.bytes), 4, "invalid byte lenght")
+  assertEquals(t, string(entry.content), "bbbb", "invalid content")
+  assertEquals(t, int(err), Ok, "Invalid err ")
 }
 
 
 func TestReplaceShouldFailIfKeyNotExists(t *testing.T) {
 
-  storage := newMapStorage()
+  storage := newMapCacheStorage(serverClock)
   
-  err := storage.Replace("foo", 0, 60, 4, []byte("aaaa"))
+  err, _, _ := storage.Replace("foo", 0, 0, 4, []byte("aaaa"))
 
-  assertNotEquals(t, err, nil, "invalid error")
+  assertNotEquals(t, int(err), Ok, "invalid error")
 }
 
 func TestShouldAppendContentForKey(t *testing.T) {
 
-  storage := newMapStorage()
+  storage := newMapCacheStorage(serverClock)
   
-  storage.Set("foo", 0, 60, 5, []byte("aaaaa"))
-  err := storage.Append("foo", 4, []byte("bbbb"))
+  storage.Set("foo", 0, 0, 5, []byte("aaaaa"))
+  storage.Append("foo", 4, []byte("bbbb"))
 
-  flag, bytes, _, content, err := storage.Get("foo") 
+  err, entry := storage.Get("foo")
 
-  assertEquals(t, int(flag), 0, "invalid flag")
-  assertEquals(t, int(bytes), 9, "invalid byte lenght")
-  assertEquals(t, string(content), "aaaaabbbb", "invalid content")
-  assertEquals(t, err, nil, "Invalid err ")
+  assertEquals(t, int(entry.flags), 0, "invalid flag")
+  assertEquals(t, int(entry.bytes), 9, "invalid byte lenght")
+  assertEquals(t, string(entry.content), "aaaaabbbb", "invalid content")
+  assertEquals(t, int(err), Ok, "Invalid err ")
 }
 
 
 func TestShouldPrependContentForKey(t *testing.T) {
 
-  storage := newMapStorage()
+  storage := newMapCacheStorage(serverClock)
   
-  storage.Set("foo", 0, 60, 5, []byte("aaaaa"))
-  err := storage.Prepend("foo", 4, []byte("bbbb"))
+  storage.Set("foo", 0, 0, 5, []byte("aaaaa"))
+  storage.Prepend("foo", 4, []byte("bbbb"))
 
-  flag, bytes, _, content, err := storage.Get("foo") 
+  err, entry := storage.Get("foo")
 
-  assertEquals(t, int(flag), 0, "invalid flag")
-  assertEquals(t, int(bytes), 9, "invalid byte lenght")
-  assertEquals(t, string(content), "bbbbaaaaa", "invalid content")
-  assertEquals(t, err, nil, "Invalid err ")
+  assertEquals(t, int(entry.flags), 0, "invalid flag")
+  assertEquals(t, int(entry.bytes), 9, "invalid byte lenght")
+  assertEquals(t, string(entry.content), "bbbbaaaaa", "invalid content")
+  assertEquals(t, int(err), Ok, "Invalid err ")
+}
+
+func TestAccessIsTracked(t *testing.T) {
+
+  storage := newMapCacheStorage(serverClock)
+
+  storage.Set("foo", 0, 0, 5, []byte("aaaaa"))
+  storage.Get("foo")
+  storage.GetMulti([]string{"foo", "bar"})
+  _, entry := storage.Get("foo")
+  access := entry.accessInfo()
+
+  assertEquals(t, int(access.fetches), 3, "invalid fetches")
+  assertEquals(t, int(access.fetched), 3, "invalid fetches since written")
+  assertNotEquals(t, int(access.created), 0, "invalid creation time")
+
+  storage.Append("foo", 1, []byte("b"))
+  storage.Touch("foo", 0)
+  _, entry = storage.Get("foo")
+  access = entry.accessInfo()
+
+  assertEquals(t, int(access.fetches), 4, "fetches not kept when appending")
+  assertEquals(t, int(access.fetched), 1, "fetches since written not reset when appending")
+
+  storage.Set("foo", 0, 0, 5, []byte("ccccc"))
+  storage.Iterate(func(key string, entry *StorageEntry) bool {
+    assertEquals(t, int(entry.accessInfo().fetches), 0, "fetches not reset when storing")
+    return true
+  })
 }
 
 func assertEquals(t *testing.T, a interface{}, b interface{}, cause string) {
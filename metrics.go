@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"http"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// upper bounds of the command latency histogram buckets, in seconds
+var latencyBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// replies counted as the result of a command, anything else is "other"
+var commandResults = map[string]bool{
+	"STORED": true, "NOT_STORED": true, "EXISTS": true, "NOT_FOUND": true, "DELETED": true,
+	"TOUCHED": true, "VALUE": true, "END": true, "OK": true, "ERROR": true,
+	"CLIENT_ERROR": true, "SERVER_ERROR": true, "VA": true, "HD": true, "EN": true,
+}
+
+// the results above, to remember replies without allocating
+var replyWords = make(map[string]string)
+
+func init() {
+	for result := range commandResults {
+		replyWords[result] = result
+	}
+}
+
+var updateOps = []string{Delete: "delete", Add: "add", Change: "change", Touch: "touch", Expire: "expire", Evict: "evict"}
+
+type histogram struct {
+	buckets []uint64 // non cumulative counts, the last one is +Inf
+	sum     int64    // nanoseconds
+	count   uint64
+}
+
+func (self *histogram) observe(ns int64) {
+	seconds := float64(ns) / 1e9
+	i := 0
+	for i < len(latencyBuckets) && seconds > latencyBuckets[i] {
+		i++
+	}
+	self.buckets[i] += 1
+	self.sum += ns
+	self.count += 1
+}
+
+// Counters exposed in the Prometheus text format by the metrics HTTP server.
+// It also counts the storage updates as an UpdateListener.
+type Metrics struct {
+	lock       sync.Mutex
+	commands   map[string]uint64 // by "command result"
+	latencies  map[string]*histogram
+	updates    []uint64 // by UpdateMessage op
+	getHits    uint64
+	getMisses  uint64
+	partitions func() []CacheStorage
+}
+
+func newMetrics(partitions func() []CacheStorage) *Metrics {
+	return &Metrics{
+		commands:   make(map[string]uint64),
+		latencies:  make(map[string]*histogram),
+		updates:    make([]uint64, len(updateOps)),
+		partitions: partitions,
+	}
+}
+
+func (self *Metrics) Updated(msg UpdateMessage) {
+	atomic.AddUint64(&self.updates[msg.op], 1)
+}
+
+// Count a processed command by its reply. elapsed is the Exec time in nanoseconds,
+// or -1 if it failed parsing.
+func (self *Metrics) command(name string, reply string, elapsed int64) {
+	if !commandResults[reply] {
+		if reply != "" && reply[0] >= '0' && reply[0] <= '9' {
+			reply = "VALUE" // incr/decr
+		} else if reply == "" {
+			reply = "noreply"
+		} else {
+			reply = "other"
+		}
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.commands[name+" "+reply] += 1
+	if elapsed >= 0 {
+		h, present := self.latencies[name]
+		if !present {
+			h = &histogram{buckets: make([]uint64, len(latencyBuckets)+1)}
+			self.latencies[name] = h
+		}
+		h.observe(elapsed)
+	}
+}
+
+func (self *Metrics) get(hit bool) {
+	if hit {
+		atomic.AddUint64(&self.getHits, 1)
+	} else {
+		atomic.AddUint64(&self.getMisses, 1)
+	}
+}
+
+// Write every metric in the Prometheus text format
+func (self *Metrics) expose(w io.Writer) {
+	self.lock.Lock()
+	commands := make([]string, 0, len(self.commands))
+	for key, _ := range self.commands {
+		commands = append(commands, key)
+	}
+	sort.Strings(commands)
+	header(w, "gocached_commands_total", "counter", "Commands processed, by command and reply.")
+	for _, key := range commands {
+		labels := strings.Split(key, " ")
+		fmt.Fprintf(w, "gocached_commands_total{command=%q,result=%q} %d\n", labels[0], labels[1], self.commands[key])
+	}
+	names := make([]string, 0, len(self.latencies))
+	for name, _ := range self.latencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	header(w, "gocached_command_duration_seconds", "histogram", "Command execution time, by command.")
+	for _, name := range names {
+		h := self.latencies[name]
+		cumulative := uint64(0)
+		for i, bound := range latencyBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(w, "gocached_command_duration_seconds_bucket{command=%q,le=\"%g\"} %d\n", name, bound, cumulative)
+		}
+		fmt.Fprintf(w, "gocached_command_duration_seconds_bucket{command=%q,le=\"+Inf\"} %d\n", name, h.count)
+		fmt.Fprintf(w, "gocached_command_duration_seconds_sum{command=%q} %g\n", name, float64(h.sum)/1e9)
+		fmt.Fprintf(w, "gocached_command_duration_seconds_count{command=%q} %d\n", name, h.count)
+	}
+	self.lock.Unlock()
+	latencies.expose(w)
+	if compressor != nil {
+		compressor.expose(w)
+	}
+
+	header(w, "gocached_get_hits_total", "counter", "Keys found by get and gets.")
+	fmt.Fprintf(w, "gocached_get_hits_total %d\n", atomic.AddUint64(&self.getHits, 0))
+	header(w, "gocached_get_misses_total", "counter", "Keys not found by get and gets.")
+	fmt.Fprintf(w, "gocached_get_misses_total %d\n", atomic.AddUint64(&self.getMisses, 0))
+	header(w, "gocached_updates_total", "counter", "Storage updates, expirations and evictions, by operation.")
+	for op, name := range updateOps {
+		fmt.Fprintf(w, "gocached_updates_total{op=%q} %d\n", name, atomic.AddUint64(&self.updates[op], 0))
+	}
+
+	header(w, "gocached_partition_items", "gauge", "Items stored, by partition, expired ones not removed yet included.")
+	partitions := self.partitions()
+	for i, partition := range partitions {
+		if stats, ok := partition.(*MapCacheStorage); ok {
+			items, _ := stats.Stats()
+			fmt.Fprintf(w, "gocached_partition_items{partition=\"%d\"} %d\n", i, items)
+		}
+	}
+	header(w, "gocached_partition_bytes", "gauge", "Approximate size of the keys and data stored, by partition.")
+	for i, partition := range partitions {
+		if stats, ok := partition.(*MapCacheStorage); ok {
+			_, bytes := stats.Stats()
+			fmt.Fprintf(w, "gocached_partition_bytes{partition=\"%d\"} %d\n", i, bytes)
+		}
+	}
+
+	header(w, "gocached_expirer_collections_total", "counter", "Expirer collections.")
+	fmt.Fprintf(w, "gocached_expirer_collections_total %d\n", atomic.AddUint64(&expirerStats.collections, 0))
+	header(w, "gocached_expirer_collection_seconds_total", "counter", "Time spent in expirer collections.")
+	fmt.Fprintf(w, "gocached_expirer_collection_seconds_total %g\n", float64(atomic.AddUint64(&expirerStats.collectionNanos, 0))/1e9)
+	header(w, "gocached_expirer_expired_total", "counter", "Items removed by the expirer.")
+	fmt.Fprintf(w, "gocached_expirer_expired_total %d\n", atomic.AddUint64(&expirerStats.expired, 0))
+	header(w, "gocached_expirer_rescheduled_total", "counter", "Stale expirer schedules found and rescheduled.")
+	fmt.Fprintf(w, "gocached_expirer_rescheduled_total %d\n", atomic.AddUint64(&expirerStats.rescheduled, 0))
+	header(w, "gocached_expirer_resyncs_total", "counter", "Expirer schedules rebuilt after dropping updates.")
+	fmt.Fprintf(w, "gocached_expirer_resyncs_total %d\n", atomic.AddUint64(&expirerStats.resyncs, 0))
+
+	header(w, "gocached_connections", "gauge", "Open client connections.")
+	fmt.Fprintf(w, "gocached_connections %d\n", atomic.AddInt64(&connections, 0))
+	header(w, "gocached_connections_total", "counter", "Client connections accepted.")
+	fmt.Fprintf(w, "gocached_connections_total %d\n", atomic.AddUint64(&acceptedConnections, 0))
+	header(w, "gocached_connections_refused_total", "counter", "Client connections refused over max-connections.")
+	fmt.Fprintf(w, "gocached_connections_refused_total %d\n", atomic.AddUint64(&refusedConnections, 0))
+}
+
+func header(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Count a command, when metrics are enabled. Unknown commands are counted together.
+func recordCommand(name string, cmd Command, reply string, elapsed int64) {
+	if metrics == nil {
+		return
+	}
+	if _, unknown := cmd.(*UnknownCommand); unknown {
+		name = "unknown"
+	}
+	metrics.command(name, reply, elapsed)
+}
+
+// Count a get hit or miss, when metrics are enabled
+func recordGet(hit bool) {
+	if metrics != nil {
+		metrics.get(hit)
+	}
+}
+
+// Serve /metrics over HTTP on addr
+func serveMetrics(addr string) {
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.expose(w)
+	})
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		logger.Fatal("Unable to serve metrics", "addr", addr, "err", err)
+	}
+}
+
+// Client connection remembering the first word written since reply was reset,
+// which is the result of the command being run
+type sessionConn struct {
+	*net.TCPConn
+	reply string
+}
+
+func (self *sessionConn) Write(b []byte) (int, os.Error) {
+	if self.reply == "" {
+		end := 0
+		for end < len(b) && b[end] != ' ' && b[end] != '\r' {
+			end++
+		}
+		if result, known := replyWords[string(b[:end])]; known {
+			self.reply = result
+		} else {
+			self.reply = string(b[:end])
+		}
+	}
+	return self.TCPConn.Write(b)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// events buffered per watcher, further events are dropped and reported as lost
+const mutationWatcherBuffer = 1000
+
+// Feed of key updates for sessions turned into watchers by "watch_mutations".
+// Publishing never blocks writers: a watcher that can't keep up loses events,
+// and is told how many before its next event.
+type MutationStream struct {
+	mutex    sync.RWMutex
+	watchers map[*mutationWatcher]bool
+}
+
+type mutationWatcher struct {
+	prefixes []string // only keys with any of these prefixes, all keys if empty
+	events   chan UpdateMessage
+	lostLock sync.Mutex
+	lost     uint64
+}
+
+func newMutationStream() *MutationStream {
+	return &MutationStream{watchers: make(map[*mutationWatcher]bool)}
+}
+
+func (self *MutationStream) Subscribe(prefixes []string) *mutationWatcher {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	watcher := &mutationWatcher{prefixes: prefixes, events: make(chan UpdateMessage, mutationWatcherBuffer)}
+	self.watchers[watcher] = true
+	return watcher
+}
+
+func (self *MutationStream) Unsubscribe(watcher *mutationWatcher) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.watchers[watcher] = false, false
+}
+
+// UpdateListener implementation
+func (self *MutationStream) Updated(msg UpdateMessage) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	for watcher, _ := range self.watchers {
+		if !watcher.matches(msg.key) {
+			continue
+		}
+		select {
+		case watcher.events <- msg:
+		default:
+			watcher.lostLock.Lock()
+			watcher.lost += 1
+			watcher.lostLock.Unlock()
+		}
+	}
+}
+
+func (self *mutationWatcher) matches(key string) bool {
+	if len(self.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range self.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// lost events since the last call
+func (self *mutationWatcher) takeLost() uint64 {
+	self.lostLock.Lock()
+	defer self.lostLock.Unlock()
+	lost := self.lost
+	self.lost = 0
+	return lost
+}
+
+// logfmt line describing an update made at now
+func mutationLine(msg UpdateMessage, now int64) string {
+	switch msg.op {
+	case Add, Change:
+		return fmt.Sprintf("ts=%d type=set key=%s exptime=%d\r\n", now, msg.key, msg.newEpoch)
+	case Touch:
+		return fmt.Sprintf("ts=%d type=touch key=%s exptime=%d\r\n", now, msg.key, msg.newEpoch)
+	case Delete:
+		return fmt.Sprintf("ts=%d type=delete key=%s\r\n", now, msg.key)
+	case Expire:
+		return fmt.Sprintf("ts=%d type=expire key=%s\r\n", now, msg.key)
+	case Evict:
+		return fmt.Sprintf("ts=%d type=evict key=%s\r\n", now, msg.key)
+	}
+	return ""
+}
+
+// Turn the session into a mutations watcher. It takes no more commands and streams
+// events until the client disconnects, or the connection fails and is closed, which
+// ends the session.
+func (s *Session) streamMutations(prefixes []string) {
+	watcher := mutations.Subscribe(prefixes)
+	defer mutations.Unsubscribe(watcher)
+	closed := make(chan bool, 1)
+	go func() {
+		for {
+			if _, err := s.bufreader.ReadByte(); err != nil {
+				closed <- true
+				return
+			}
+		}
+	}()
+	// the reader only stops once the connection is closed
+	disconnect := func() {
+		s.conn.Close()
+		<-closed
+	}
+	if _, err := s.conn.Write([]byte("OK\r\n")); err != nil {
+		disconnect()
+		return
+	}
+	for {
+		select {
+		case msg := <-watcher.events:
+			if lost := watcher.takeLost(); lost > 0 {
+				line := fmt.Sprintf("ts=%d type=lost count=%d\r\n", s.clock.Seconds(), lost)
+				if _, err := s.conn.Write([]byte(line)); err != nil {
+					disconnect()
+					return
+				}
+			}
+			if _, err := s.conn.Write([]byte(mutationLine(msg, s.clock.Seconds()))); err != nil {
+				disconnect()
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A request and the whole response expected for it
+type exchange struct {
+	name     string
+	request  string
+	response string
+}
+
+var longKey = strings.Repeat("k", maxKeyLength+1)
+
+var largeValue = strings.Repeat("x", defaultMaxItemSize+1)
+
+var protocolExchanges = []exchange{
+	// storage commands
+	{"set and get", "set s1 5 0 3\r\nabc\r\nget s1\r\n", "STORED\r\nVALUE s1 5 3\r\nabc\r\nEND\r\n"},
+	{"set replaces", "set s2 0 0 1\r\na\r\nset s2 1 0 2\r\nbb\r\nget s2\r\n", "STORED\r\nSTORED\r\nVALUE s2 1 2\r\nbb\r\nEND\r\n"},
+	{"set noreply", "set s3 0 0 1 noreply\r\na\r\nget s3\r\n", "VALUE s3 0 1\r\na\r\nEND\r\n"},
+	{"noreply applies to its command only", "set s5 0 0 1 noreply\r\na\r\nset s5 0 0 1\r\nb\r\n", "STORED\r\n"},
+	{"set expired", "set s4 0 1 1\r\na\r\nset s4 0 1000000000 1\r\na\r\nget s4\r\n", "STORED\r\nSTORED\r\nEND\r\n"},
+	{"add", "add a1 0 0 1\r\na\r\nadd a1 0 0 1\r\nb\r\nget a1\r\n", "STORED\r\nNOT_STORED\r\nVALUE a1 0 1\r\na\r\nEND\r\n"},
+	{"add noreply", "add a2 0 0 1 noreply\r\na\r\nadd a2 0 0 1 noreply\r\nb\r\nget a2\r\n", "VALUE a2 0 1\r\na\r\nEND\r\n"},
+	{"replace", "replace r1 0 0 1\r\na\r\nset r1 0 0 1\r\na\r\nreplace r1 3 0 1\r\nb\r\nget r1\r\n",
+		"NOT_STORED\r\nSTORED\r\nSTORED\r\nVALUE r1 3 1\r\nb\r\nEND\r\n"},
+	{"replace noreply", "replace r2 0 0 1 noreply\r\na\r\nget r2\r\n", "END\r\n"},
+	{"append", "append p1 0 0 1\r\na\r\nset p1 2 0 2\r\nab\r\nappend p1 0 0 2\r\ncd\r\nget p1\r\n",
+		"NOT_STORED\r\nSTORED\r\nSTORED\r\nVALUE p1 2 4\r\nabcd\r\nEND\r\n"},
+	{"prepend", "prepend p2 0 0 1\r\na\r\nset p2 2 0 2\r\nab\r\nprepend p2 0 0 2 noreply\r\ncd\r\nget p2\r\n",
+		"NOT_STORED\r\nSTORED\r\nVALUE p2 2 4\r\ncdab\r\nEND\r\n"},
+	{"append too large", "set p3 0 0 " + fmt.Sprint(defaultMaxItemSize) + "\r\n" + largeValue[1:] + "\r\nappend p3 0 0 1\r\na\r\nprepend p3 0 0 1 noreply\r\na\r\nmg p3 s\r\n",
+		"STORED\r\nSERVER_ERROR out of memory storing object\r\nSERVER_ERROR out of memory storing object\r\nHD s" + fmt.Sprint(defaultMaxItemSize) + "\r\n"},
+	{"binary data", "set b1 0 0 4\r\n\r\n\x00\n\r\nget b1\r\n", "STORED\r\nVALUE b1 0 4\r\n\r\n\x00\n\r\nEND\r\n"},
+
+	// retrieval, delete, incr/decr and touch commands
+	{"get multiple keys", "set g1 0 0 1\r\na\r\nset g2 0 0 1\r\nb\r\nget g1 missing g2\r\n",
+		"STORED\r\nSTORED\r\nVALUE g1 0 1\r\na\r\nVALUE g2 0 1\r\nb\r\nEND\r\n"},
+	{"get missing", "get missing\r\n", "END\r\n"},
+	{"get longer than the read buffer", "set g3 0 0 1\r\na\r\nget" + strings.Repeat(" missing", 1000) + " g3\r\n",
+		"STORED\r\nVALUE g3 0 1\r\na\r\nEND\r\n"},
+	{"delete", "set d1 0 0 1\r\na\r\ndelete d1\r\ndelete d1\r\nget d1\r\n", "STORED\r\nDELETED\r\nNOT_FOUND\r\nEND\r\n"},
+	{"delete noreply", "set d2 0 0 1\r\na\r\ndelete d2 noreply\r\ndelete d2 noreply\r\nget d2\r\n", "STORED\r\nEND\r\n"},
+	{"incr and decr", "set i1 0 0 2\r\n10\r\nincr i1 5\r\ndecr i1 3\r\ndecr i1 20\r\nget i1\r\n",
+		"STORED\r\n15\r\n12\r\n0\r\nVALUE i1 0 1\r\n0\r\nEND\r\n"},
+	{"incr noreply", "set i2 0 0 1\r\n1\r\nincr i2 1 noreply\r\nget i2\r\n", "STORED\r\nVALUE i2 0 1\r\n2\r\nEND\r\n"},
+	{"incr missing", "incr i3 1\r\ndecr i3 1\r\n", "NOT_FOUND\r\nNOT_FOUND\r\n"},
+	{"incr non numeric", "set i4 0 0 1\r\na\r\nincr i4 1\r\n",
+		"STORED\r\nCLIENT_ERROR cannot increment or decrement non-numeric value\r\n"},
+	{"touch", "touch t1 0\r\nset t1 0 0 1\r\na\r\ntouch t1 1000\r\nget t1\r\n", "NOT_FOUND\r\nSTORED\r\nTOUCHED\r\nVALUE t1 0 1\r\na\r\nEND\r\n"},
+	{"touch expires", "set t2 0 0 1\r\na\r\ntouch t2 1000000000 noreply\r\nget t2\r\n", "STORED\r\nEND\r\n"},
+	{"negative exptime", "set x1 0 -1 1\r\na\r\nget x1\r\nadd x1 0 0 1\r\nb\r\nget x1\r\n",
+		"STORED\r\nEND\r\nSTORED\r\nVALUE x1 0 1\r\nb\r\nEND\r\n"},
+	{"touch negative exptime", "set x2 0 0 1\r\na\r\ntouch x2 -1\r\nget x2\r\n", "STORED\r\nTOUCHED\r\nEND\r\n"},
+	{"mg", "set m1 5 0 3\r\nabc\r\nmg m1 v f s k Oq\r\nmg m1\r\nmg missing v\r\n",
+		"STORED\r\nVA 3 f5 s3 km1 Oq\r\nabc\r\nHD\r\nEN\r\n"},
+	{"mg hit before", "set m2 0 0 1\r\na\r\nmg m2 h t\r\nmg m2 h\r\nset m2 0 0 1\r\nb\r\nmg m2 h\r\n",
+		"STORED\r\nHD h0 t-1\r\nHD h1\r\nSTORED\r\nHD h0\r\n"},
+	{"empty value", "set m3 0 0 0\r\n\r\nget m3\r\nappend m3 0 0 1\r\na\r\nget m3\r\n",
+		"STORED\r\nVALUE m3 0 0\r\n\r\nEND\r\nSTORED\r\nVALUE m3 0 1\r\na\r\nEND\r\n"},
+
+	// parse errors, the data block is swallowed when the byte-length is known
+	{"unknown command", "bogus\r\n", "ERROR\r\n"},
+	{"empty line", "\r\n", "ERROR\r\n"},
+	{"unimplemented command", "version\r\n", "SERVER_ERROR Not Implemented\r\n"},
+	{"set missing parameters", "set e1 0 0\r\n", "CLIENT_ERROR Bad storage command: missing parameters\r\n"},
+	{"set bad byte-length", "set e1 0 0 x\r\n", "CLIENT_ERROR Bad storage command: bad byte-length\r\n"},
+	{"set bad flags", "set e1 x 0 1\r\na\r\n", "CLIENT_ERROR Bad storage command: bad flags\r\n"},
+	{"set bad expiration time", "set e1 0 x 1\r\na\r\n", "CLIENT_ERROR Bad storage command: bad expiration time\r\n"},
+	{"set expiration time out of range", "set e1 0 2147483648 1\r\na\r\nset e1 0 -2147483649 1\r\na\r\n",
+		"CLIENT_ERROR Bad storage command: bad expiration time\r\nCLIENT_ERROR Bad storage command: bad expiration time\r\n"},
+	{"set too large", "set e1 0 0 " + fmt.Sprint(len(largeValue)) + "\r\n" + largeValue + "\r\nget e1\r\n",
+		"SERVER_ERROR object too large for cache\r\nEND\r\n"},
+	{"set byte-length overflow", "set e1 0 0 18446744073709551615\r\nget e1\r\n", "CLIENT_ERROR bad data chunk\r\nEND\r\n"},
+	{"set long key", "set " + longKey + " 0 0 1\r\na\r\n", "CLIENT_ERROR bad command line format\r\n"},
+	{"set control characters", "set e\x01 0 0 1\r\na\r\n", "CLIENT_ERROR bad command line format\r\n"},
+	{"cas missing unique", "cas e1 0 0 1\r\na\r\n", "CLIENT_ERROR Bad storage command: missing parameters\r\n"},
+	{"cas bad unique", "cas e1 0 0 1 x\r\na\r\n", "CLIENT_ERROR Bad storage command: bad cas value\r\n"},
+	{"get missing parameters", "get\r\n", "CLIENT_ERROR Bad retrieval command: missing parameters\r\n"},
+	{"get long key", "get e1 " + longKey + "\r\n", "CLIENT_ERROR bad command line format\r\n"},
+	{"delete missing parameters", "delete\r\n", "CLIENT_ERROR Bad delete command: missing parameters\r\n"},
+	{"delete long key", "delete " + longKey + "\r\n", "CLIENT_ERROR bad command line format\r\n"},
+	{"incr missing parameters", "incr e1\r\n", "CLIENT_ERROR Bad incr/decr command: missing parameters\r\n"},
+	{"incr bad value", "incr e1 x\r\n", "CLIENT_ERROR Bad incr/decr command: bad value\r\n"},
+	{"touch missing parameters", "touch e1\r\n", "CLIENT_ERROR Bad touch command: missing parameters\r\n"},
+	{"touch bad expiration time", "touch e1 x\r\n", "CLIENT_ERROR Bad touch command: bad expiration time\r\n"},
+	{"mg missing parameters", "mg\r\n", "CLIENT_ERROR Bad mg command: missing parameters\r\n"},
+	{"mg invalid flag", "mg m1 vv\r\nmg m1 x\r\n", "CLIENT_ERROR invalid flag\r\nCLIENT_ERROR invalid flag\r\n"},
+
+	// server commands, the optional features are disabled here
+	{"stats", "stats\r\n", "SERVER_ERROR Not Implemented\r\n"},
+	{"stats unknown group", "stats bogus\r\n", "CLIENT_ERROR Bad stats command: unknown statistics group\r\n"},
+	{"stats hotkeys", "stats hotkeys\r\n", "SERVER_ERROR hot keys detection disabled\r\n"},
+	{"stats partitions", "stats partitions\r\n", "SERVER_ERROR partitions disabled\r\n"},
+	{"stats latency reset", "stats latency reset\r\n", "RESET\r\n"},
+	{"stats cachedump bad limit", "stats cachedump -1\r\n", "CLIENT_ERROR Bad stats command: bad limit\r\n"},
+	{"stats cachedump no limit", "stats cachedump 0\r\n", "CLIENT_ERROR Bad stats command: bad limit\r\n"},
+	{"config missing parameters", "config\r\n", "CLIENT_ERROR Bad config command: missing parameters\r\n"},
+	{"config unknown subcommand", "config bogus\r\n", "CLIENT_ERROR Bad config command: unknown subcommand\r\n"},
+	{"config set missing value", "config set max-memory\r\n", "CLIENT_ERROR Bad config command: expected config set <name> <value>\r\n"},
+	{"config set unknown", "config set bogus 1\r\n", "CLIENT_ERROR unknown setting bogus\r\n"},
+	{"config get unknown", "config get bogus\r\n", "END\r\n"},
+	{"config reload", "config reload\r\n", "SERVER_ERROR no config file given\r\n"},
+	{"verbosity missing level", "verbosity\r\n", "CLIENT_ERROR Bad verbosity command: expected verbosity <level> [noreply]\r\n"},
+	{"slowlog", "slowlog get\r\n", "SERVER_ERROR slow log disabled\r\n"},
+	{"debug", "debug skew 10\r\n", "SERVER_ERROR debug commands disabled\r\n"},
+	{"repartition", "repartition 2\r\n", "SERVER_ERROR partitions disabled\r\n"},
+	{"cluster", "cluster members\r\n", "SERVER_ERROR clustering disabled\r\n"},
+	{"watch", "watch w1 w2\r\nunwatch w1\r\n", "OK\r\nOK\r\n"},
+	{"watch a key named mutations", "watch mutations\r\nunwatch mutations\r\n", "OK\r\nOK\r\n"},
+	{"watch missing parameters", "watch\r\n", "CLIENT_ERROR Bad watch command: missing parameters\r\n"},
+	{"watch long key", "watch " + longKey + "\r\n", "CLIENT_ERROR bad command line format\r\n"},
+}
+
+// What the protocol helpers need of a test or benchmark
+type reporter interface {
+	Fatal(args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Start an in-process server with an empty storage, returns its address
+func startTestServer(t reporter) string {
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatal("Unable to listen:", err)
+	}
+	storage := newEventNotifierStorage(newMapCacheStorage(serverClock), nil, watches, mutations)
+	go serve(listener, newLatencyStorage(storage, latencies), serverClock)
+	return listener.Addr().String()
+}
+
+type testClient struct {
+	t      reporter
+	conn   *net.TCPConn
+	reader *bufio.Reader
+}
+
+func newTestClient(t reporter, server string) *testClient {
+	addr, _ := net.ResolveTCPAddr("tcp", server)
+	conn, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		t.Fatal("Unable to connect:", err)
+	}
+	return &testClient{t, conn, bufio.NewReader(conn)}
+}
+
+func (self *testClient) send(request string) {
+	if _, err := self.conn.Write([]byte(request)); err != nil {
+		self.t.Fatal("Unable to send:", err)
+	}
+}
+
+// Read exactly as many bytes as expected, failing after a few seconds
+func (self *testClient) read(expected int) string {
+	done := make(chan string, 1)
+	go func() {
+		buffer := make([]byte, expected)
+		n, _ := io.ReadFull(self.reader, buffer)
+		done <- string(buffer[:n])
+	}()
+	select {
+	case response := <-done:
+		return response
+	case <-time.After(5e9):
+		self.conn.Close()
+		return <-done
+	}
+	return ""
+}
+
+// Send a request and check the whole response. A get of a missing key follows it,
+// to check that nothing else was written and that the connection stays in sync.
+func (self *testClient) exchange(name string, request string, response string) {
+	self.send(request + "get sync\r\n")
+	expected := response + "END\r\n"
+	if got := self.read(len(expected)); got != expected {
+		self.t.Errorf("%s: expected %q, got %q", name, abbreviate(expected), abbreviate(got))
+	}
+}
+
+func (self *testClient) Close() {
+	self.conn.Close()
+}
+
+func abbreviate(s string) string {
+	if len(s) > 200 {
+		return s[:200] + "..."
+	}
+	return s
+}
+
+func TestProtocolExchanges(t *testing.T) {
+	server := startTestServer(t)
+	for _, e := range protocolExchanges {
+		client := newTestClient(t, server)
+		client.exchange(e.name, e.request, e.response)
+		client.Close()
+	}
+}
+
+func TestProtocolCas(t *testing.T) {
+	client := newTestClient(t, startTestServer(t))
+	defer client.Close()
+	client.exchange("cas missing", "cas c1 0 0 1 1\r\na\r\n", "NOT_FOUND\r\n")
+	client.send("set c1 0 0 1\r\na\r\ngets c1\r\n")
+	line, _ := client.reader.ReadString('\n')
+	line, _ = client.reader.ReadString('\n')
+	var cas uint64
+	if _, err := fmt.Sscanf(line, "VALUE c1 0 1 %d\r\n", &cas); err != nil {
+		t.Fatalf("Bad gets reply %q", line)
+	}
+	client.read(len("a\r\nEND\r\n"))
+	client.exchange("cas modified", fmt.Sprintf("cas c1 0 0 1 %d\r\nb\r\n", cas+1), "EXISTS\r\n")
+	client.exchange("cas", fmt.Sprintf("cas c1 0 0 1 %d\r\nb\r\nget c1\r\n", cas), "STORED\r\nVALUE c1 0 1\r\nb\r\nEND\r\n")
+	client.exchange("cas again", fmt.Sprintf("cas c1 0 0 1 %d\r\nc\r\n", cas), "EXISTS\r\n")
+	client.exchange("cas after delete", fmt.Sprintf("delete c1\r\nset c1 0 0 1\r\na\r\ncas c1 0 0 1 %d\r\nc\r\n", cas),
+		"DELETED\r\nSTORED\r\nEXISTS\r\n")
+	client.exchange("cas noreply", fmt.Sprintf("cas c1 0 0 1 %d noreply\r\nc\r\n", cas), "")
+}
+
+func TestProtocolPipelining(t *testing.T) {
+	client := newTestClient(t, startTestServer(t))
+	defer client.Close()
+	request, response := "", ""
+	for i := 0; i < 200; i++ {
+		request += fmt.Sprintf("set pipe%d 0 0 %d\r\n%d\r\nget pipe%d\r\n", i, len(fmt.Sprint(i)), i, i)
+		response += fmt.Sprintf("STORED\r\nVALUE pipe%d 0 %d\r\n%d\r\nEND\r\n", i, len(fmt.Sprint(i)), i)
+	}
+	client.exchange("pipelined requests", request, response)
+}
+
+func TestProtocolSplitWrites(t *testing.T) {
+	client := newTestClient(t, startTestServer(t))
+	defer client.Close()
+	request := "set split 0 0 10\r\n0123456789\r\nget split\r\n"
+	for i := 0; i < len(request); i++ {
+		client.send(request[i : i+1])
+		time.Sleep(1e5)
+	}
+	client.exchange("split writes", "", "STORED\r\nVALUE split 0 10\r\n0123456789\r\nEND\r\n")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func waitMigration(t *testing.T, storage *HashingStorage) {
+	for i := 0; i < 100; i++ {
+		if _, old, _ := storage.Size(); old == 0 {
+			return
+		}
+		time.Sleep(1e7)
+	}
+	t.Fatal("migration didn't finish")
+}
+
+func checkKeys(t *testing.T, storage CacheStorage, count int, prefix string) {
+	for i := 0; i < count; i++ {
+		key := fmt.Sprintf("%s%d", prefix, i)
+		if err, entry := storage.Get(key); err != Ok || string(entry.content) != key {
+			t.Errorf("%s lost", key)
+		}
+	}
+}
+
+func TestRepartitionKeepsEveryEntry(t *testing.T) {
+	storage := newHashingStorage(3, base_storage_factory)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		storage.Set(key, 0, 0, uint32(len(key)), []byte(key))
+	}
+	for _, size := range []uint32{7, 1, 16} {
+		if err := storage.Resize(size); err != nil {
+			t.Fatal(err)
+		}
+		// entries accessed while migrating are moved right away
+		checkKeys(t, storage, 100, "key")
+		waitMigration(t, storage)
+		checkKeys(t, storage, 1000, "key")
+		if buckets := storage.Buckets(); len(buckets) != int(size) {
+			t.Errorf("Expected %d partitions, got %d", size, len(buckets))
+		}
+	}
+	visited := 0
+	storage.Iterate(func(key string, entry *StorageEntry) bool {
+		visited += 1
+		return true
+	})
+	assertEquals(t, visited, 1000, "entries visited after resizing")
+}
+
+func TestRepartitionWhileWriting(t *testing.T) {
+	storage := newHashingStorage(4, base_storage_factory)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%d", i)
+			storage.Set(key, 0, 0, uint32(len(key)), []byte(key))
+		}
+		done <- true
+	}()
+	if err := storage.Resize(9); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	waitMigration(t, storage)
+	checkKeys(t, storage, 2000, "key")
+}
+
+func TestGetMultiKeepsOrder(t *testing.T) {
+	storage := newHashingStorage(8, base_storage_factory)
+	keys := make([]string, 0, 2*parallelGetMultiKeys)
+	for i := 0; i < 2*parallelGetMultiKeys; i++ {
+		key := fmt.Sprintf("key%d", i)
+		keys = append(keys, key)
+		if i%3 != 0 {
+			storage.Set(key, 0, 0, uint32(len(key)), []byte(key))
+		}
+	}
+	for _, size := range []uint32{8, 5} {
+		if size != 8 {
+			storage.Resize(size)
+		}
+		for n, entries := range [][]*StorageEntry{storage.GetMulti(keys[:10]), storage.GetMulti(keys)} {
+			for i, entry := range entries {
+				if i%3 == 0 && entry != nil || i%3 != 0 && (entry == nil || string(entry.content) != keys[i]) {
+					t.Errorf("%d partitions, batch %d: bad entry for %s", size, n, keys[i])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// nanoseconds between sampling rounds
+	samplingInterval = 1e8
+	// keys sampled from each partition per round
+	samplingKeys = 20
+	// max samples taken from a partition in a single round
+	samplingMaxRepeats = 16
+)
+
+// Active side of lazy expiration: every round samples random keys from each partition,
+// removing the expired ones, and samples again while over a quarter of them expired.
+// Entries nobody accesses are eventually found this way, without tracking any TTL.
+// The partitions are taken every round, as they change when repartitioning.
+func runExpirySampler(partitions func() []CacheStorage) {
+	ticker := time.NewTicker(samplingInterval)
+	for _ = range ticker.C {
+		expired := 0
+		for _, partition := range partitions() {
+			expired += sampleExpired(partition.(*MapCacheStorage))
+		}
+		if expired > 0 {
+			logger.Verbose("Sampling collected", "expired", expired)
+		}
+	}
+}
+
+// Sample a partition until few of its keys are expired, returns the amount of expired items
+func sampleExpired(partition *MapCacheStorage) int {
+	total := 0
+	for i := 0; i < samplingMaxRepeats; i++ {
+		sampled, expired := partition.ExpireSample(samplingKeys)
+		total += expired
+		if expired*4 <= sampled {
+			break
+		}
+	}
+	return total
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func newLazyFixture() (*EventNotifierStorage, *MapCacheStorage, expirationCounter) {
+	expired := make(expirationCounter)
+	var notifier *EventNotifierStorage
+	partition := newLazyMapCacheStorage(serverClock, func(key string) { notifier.Expired(key) })
+	notifier = newEventNotifierStorage(partition, nil, expired)
+	return notifier, partition, expired
+}
+
+func TestLazyExpirationOnAccess(t *testing.T) {
+	storage, partition, expired := newLazyFixture()
+	past := uint32(serverClock.Seconds()) - 1
+	storage.Set("get", 0, past, 1, []byte("a"))
+	storage.Set("incr", 0, past, 1, []byte("1"))
+	storage.Set("add", 0, past, 1, []byte("a"))
+	storage.Set("living", 0, 0, 1, []byte("a"))
+
+	if err, _ := storage.Get("get"); err != KeyNotFound {
+		t.Error("expired entry returned")
+	}
+	storage.Get("get")
+	if err, _, _ := storage.Incr("incr", 1, true); err != KeyNotFound {
+		t.Error("expired entry incremented")
+	}
+	if err, _ := storage.Add("add", 0, 0, 1, []byte("b")); err != Ok {
+		t.Error("expired entry not replaced")
+	}
+
+	for _, key := range []string{"get", "incr", "add"} {
+		assertEquals(t, expired[key], 1, fmt.Sprintf("%s expirations", key))
+	}
+	assertEquals(t, len(partition.keys), 2, "sampled keys")
+}
+
+func TestSamplingExpiresEveryExpiredEntry(t *testing.T) {
+	storage, partition, expired := newLazyFixture()
+	past := uint32(serverClock.Seconds()) - 1
+	for i := 0; i < 1000; i++ {
+		storage.Set(fmt.Sprintf("expired%d", i), 0, past, 1, []byte("a"))
+	}
+	for i := 0; i < 10; i++ {
+		storage.Set(fmt.Sprintf("living%d", i), 0, 0, 1, []byte("a"))
+	}
+	for i := 0; i < 1000 && len(partition.keys) > 10; i++ {
+		sampleExpired(partition)
+	}
+	assertEquals(t, len(expired), 1000, "expired keys")
+	for key, count := range expired {
+		assertEquals(t, count, 1, fmt.Sprintf("%s expirations", key))
+	}
+	for i := 0; i < 10; i++ {
+		if err, _ := storage.Get(fmt.Sprintf("living%d", i)); err != Ok {
+			t.Error("living entry expired")
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// keys kept for each slow log entry, the rest are only counted
+const slowLogMaxKeys = 10
+
+// slow log of the server, nil when disabled
+var slowLog *SlowLog
+
+// thresholds checked outside main, nil when not set up (as in tests)
+var (
+	slowLatency *int64 // microseconds
+	slowBytes   *int64
+)
+
+// A command that ran slow, or stored or retrieved large values
+type slowEntry struct {
+	id       uint64
+	time     int64 // seconds
+	client   string
+	command  string
+	keys     []string
+	nkeys    int
+	bytes    uint64
+	duration int64 // nanoseconds
+}
+
+// Last slow commands, in a bounded ring
+type SlowLog struct {
+	lock    sync.Mutex
+	entries []*slowEntry
+	next    uint64  // id of the next entry, entries[next % size] is the oldest one
+	out     *Logger // also logging every entry, nil if none
+}
+
+func newSlowLog(size int) *SlowLog {
+	return &SlowLog{entries: make([]*slowEntry, size)}
+}
+
+func (self *SlowLog) add(entry *slowEntry) {
+	self.lock.Lock()
+	entry.id = self.next
+	self.entries[self.next%uint64(len(self.entries))] = entry
+	self.next++
+	self.lock.Unlock()
+	if self.out != nil {
+		self.out.Info("Slow command", "id", entry.id, "client", entry.client, "command", entry.command,
+			"keys", strings.Join(entry.keys, " "), "nkeys", entry.nkeys, "bytes", entry.bytes,
+			"elapsed_us", entry.duration/1e3)
+	}
+}
+
+// The last count entries, newest first
+func (self *SlowLog) last(count int) []*slowEntry {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if count > len(self.entries) {
+		count = len(self.entries)
+	}
+	result := make([]*slowEntry, 0, count)
+	size := uint64(len(self.entries))
+	for id := self.next; id > 0 && self.next-id < size && len(result) < count; id-- {
+		entry := self.entries[(id-1)%size]
+		if entry == nil {
+			break
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// Drop every entry, ids keep growing
+func (self *SlowLog) reset() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i := range self.entries {
+		self.entries[i] = nil
+	}
+}
+
+func (self *slowEntry) String() string {
+	return fmt.Sprintf("%d %d %d %s %s %d %d %s", self.id, self.time, self.duration/1e3,
+		self.client, self.command, self.bytes, self.nkeys, strings.Join(self.keys, " "))
+}
+
+// Log the command just run by the session if it was slow or large, when enabled.
+// elapsed is the Exec time in nanoseconds.
+func recordSlow(s *Session, name string, elapsed int64) {
+	if slowLog == nil {
+		return
+	}
+	latency, size := settingInt64(slowLatency), settingInt64(slowBytes)
+	if (latency <= 0 || elapsed < latency*1e3) && (size <= 0 || s.bytes < uint64(size)) {
+		return
+	}
+	keys := s.keys
+	if len(keys) > slowLogMaxKeys {
+		keys = keys[:slowLogMaxKeys]
+	}
+	slowLog.add(&slowEntry{
+		time:     s.clock.Seconds(),
+		client:   s.conn.RemoteAddr().String(),
+		command:  name,
+		keys:     append([]string(nil), keys...),
+		nkeys:    len(s.keys),
+		bytes:    s.bytes,
+		duration: elapsed,
+	})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSlowLogRing(t *testing.T) {
+	log := newSlowLog(3)
+	assertEquals(t, len(log.last(3)), 0, "empty slow log")
+	for i := 0; i < 5; i++ {
+		log.add(&slowEntry{command: "get"})
+	}
+	last := log.last(10)
+	assertEquals(t, len(last), 3, "entries kept")
+	assertEquals(t, last[0].id, uint64(4), "newest entry first")
+	assertEquals(t, last[2].id, uint64(2), "oldest entry last")
+	assertEquals(t, len(log.last(1)), 1, "entries requested")
+	assertEquals(t, cap(log.last(1<<30)), 3, "entries allocated for a huge count")
+
+	log.reset()
+	assertEquals(t, len(log.last(3)), 0, "entries after reset")
+	log.add(&slowEntry{command: "set"})
+	last = log.last(3)
+	assertEquals(t, len(last), 1, "entries added after reset")
+	assertEquals(t, last[0].id, uint64(5), "ids after reset")
+}
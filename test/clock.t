@@ -0,0 +1,50 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 12;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+# expirations as in expirations.t, skewing the server clock instead of sleeping
+my $server = new_gocached("-debug-commands -storage wheel");
+my $sock = $server->sock;
+
+sub skew {
+    my ($seconds) = @_;
+    print $sock "debug skew $seconds\r\n";
+    my $reply = scalar <$sock>;
+    $reply =~ /^OK (\d+)\r\n$/ or die "Unexpected reply: $reply";
+    return $1;
+}
+
+my $now = skew(0);
+ok($now >= time() - 1, "server clock starts at the system time");
+
+print $sock "set foo 0 1 6\r\nfooval\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored foo");
+mem_get_is($sock, "foo", "fooval");
+skew(1);
+mem_get_is($sock, "foo", undef, "expired a second later");
+
+$now = skew(0);
+my $expire = $now + 100;
+print $sock "set bar 0 $expire 6\r\nbarval\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored bar with an absolute exptime");
+skew(99);
+mem_get_is($sock, "bar", "barval");
+skew(1);
+mem_get_is($sock, "bar", undef, "expired at its absolute time");
+
+print $sock "set forever 0 0 6\r\nfooval\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored forever");
+skew(100000);
+mem_get_is($sock, "forever", "fooval", "never expires");
+
+$now = skew(0);
+is(skew(-1000), $now, "the server clock never goes back");
+
+print $sock "debug skew x\r\n";
+is(scalar <$sock>, "CLIENT_ERROR Bad debug command: bad seconds\r\n", "bad skew");
+print $sock "debug\r\n";
+is(scalar <$sock>, "CLIENT_ERROR Bad debug command: expected debug skew <seconds>\r\n", "missing skew");
@@ -0,0 +1,70 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 8;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+# every node gets the same static seed list, including itself
+my ($port1, $port2) = (free_port(), free_port());
+my $peers = "-peers 127.0.0.1:$port1,127.0.0.1:$port2";
+
+my $node1 = new_gocached($peers, $port1);
+my $sock1 = $node1->sock;
+
+my $keys = 200;
+for my $i (1..$keys) {
+    my $val = "val$i";
+    print $sock1 "set key$i 0 0 " . length($val) . "\r\n$val\r\n";
+    <$sock1>;
+}
+
+print $sock1 "cluster members\r\n";
+is(scalar <$sock1>, "MEMBERS 127.0.0.1:$port1\r\n", "first node alone");
+
+# the second node joins through the seeds and takes its share of the keys
+my $node2 = new_gocached($peers, $port2);
+my $sock2 = $node2->sock;
+
+my $members = $port1 lt $port2 ? "127.0.0.1:$port1 127.0.0.1:$port2"
+                               : "127.0.0.1:$port2 127.0.0.1:$port1";
+my $line;
+for (1..50) {
+    print $sock2 "cluster members\r\n";
+    $line = <$sock2>;
+    last if $line eq "MEMBERS $members\r\n";
+    sleep(0.1);
+}
+is($line, "MEMBERS $members\r\n", "second node knows both members");
+
+print $sock1 "cluster members\r\n";
+is(scalar <$sock1>, "MEMBERS $members\r\n", "first node learned the new member");
+
+# wait until the second node serves clients
+for (1..50) {
+    print $sock2 "get key1\r\n";
+    $line = <$sock2>;
+    last if $line !~ /^SERVER_ERROR/;
+    sleep(0.1);
+}
+unlike($line, qr/^SERVER_ERROR/, "second node serving after joining");
+while ($line ne "END\r\n") { $line = <$sock2>; }
+
+# every key is in exactly one node
+my ($on1, $on2, $both) = (0, 0, 0);
+for my $i (1..$keys) {
+    print $sock1 "get key$i\r\n";
+    my $in1 = <$sock1> =~ /^VALUE/;
+    if ($in1) { <$sock1>; <$sock1>; }
+    print $sock2 "get key$i\r\n";
+    my $in2 = <$sock2> =~ /^VALUE/;
+    if ($in2) { <$sock2>; <$sock2>; }
+    $on1++ if $in1;
+    $on2++ if $in2;
+    $both++ if $in1 && $in2;
+}
+is($on1 + $on2, $keys, "no key lost during handoff");
+is($both, 0, "handed off keys removed from the old owner");
+ok($on1 > 0, "first node kept some keys");
+ok($on2 > 0, "second node received some keys");
@@ -0,0 +1,40 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 8;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+sub compression_stats {
+    my $sock = shift;
+    print $sock "stats compression\r\n";
+    my $stats = {};
+    while (<$sock>) {
+        last if /^END/;
+        /^STAT (\S+) (\S+)/;
+        $stats->{$1} = $2;
+    }
+    return $stats;
+}
+
+my $server = new_gocached("-compress-threshold=100");
+my $sock = $server->sock;
+
+my $json = '{"user": 12345, "name": "someone", "roles": ["admin", "user"]}' x 100;
+my $len = length($json);
+print $sock "set json 123 0 $len\r\n$json\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored a json blob");
+mem_get_is({ sock => $sock, flags => 123 }, "json", $json, "same bytes and flags back");
+
+print $sock "append json 0 0 2\r\n!!\r\n";
+is(scalar <$sock>, "STORED\r\n", "appended to the blob");
+mem_get_is({ sock => $sock, flags => 123 }, "json", "$json!!", "appended value, same flags");
+
+print $sock "set short 0 0 5\r\nhello\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored a short value");
+mem_get_is($sock, "short", "hello", "short value back");
+
+my $stats = compression_stats($sock);
+is($stats->{compressed_values}, 2, "the blob was compressed twice, the short value never");
+ok($stats->{compression_ratio} > 5, "json compresses over 5 times");
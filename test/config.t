@@ -0,0 +1,67 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 13;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+my $config = "/tmp/gocached-config-test.$$";
+
+sub write_config {
+    open(my $fh, ">", $config) or die "Unable to write $config: $!";
+    print $fh @_;
+    close($fh);
+}
+
+sub config_get {
+    my ($sock, $name) = @_;
+    print $sock "config get $name\r\n";
+    my $stats = {};
+    while (<$sock>) {
+        last if /^END/;
+        /^STAT (\S+) ([^\r\n]*)/;
+        $stats->{$1} = $2;
+    }
+    return $stats->{$name};
+}
+
+write_config("# test settings\n",
+             "storage = \"heap\"\n",
+             "expiring-interval = 5 # seconds\n",
+             "partitions = 3\n");
+my $server = new_gocached("-config $config -partitions 2");
+my $sock = $server->sock;
+
+is(config_get($sock, "storage"), "heap", "storage from the config file");
+is(config_get($sock, "expiring-interval"), "5", "interval from the config file");
+is(config_get($sock, "partitions"), "2", "command line wins over the config file");
+
+print $sock "config set expiring-interval 7\r\n";
+is(scalar <$sock>, "OK\r\n", "interval changed");
+is(config_get($sock, "expiring-interval"), "7", "interval changed at runtime");
+
+print $sock "config set partitions 4\r\n";
+like(scalar <$sock>, qr/^CLIENT_ERROR/, "partitions can't change while running");
+print $sock "config set expiring-interval soon\r\n";
+like(scalar <$sock>, qr/^CLIENT_ERROR/, "bad values are refused");
+
+# a SIGHUP reloads the file
+write_config("expiring-interval = 3\n", "max-memory = 1\n");
+kill 'HUP', $server->{pid};
+sleep(0.5);
+is(config_get($sock, "expiring-interval"), "3", "interval reloaded");
+is(config_get($sock, "max-memory"), "1", "memory limit reloaded");
+
+# stores fail once the memory limit is reached
+my $data = "x" x 524288;
+print $sock "set big1 0 0 524288\r\n$data\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored below the memory limit");
+print $sock "set big2 0 0 524288\r\n$data\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored reaching the memory limit");
+print $sock "set big3 0 0 1\r\nx\r\n";
+like(scalar <$sock>, qr/^SERVER_ERROR out of memory/, "store over the memory limit refused");
+print $sock "delete big1\r\n";
+is(scalar <$sock>, "DELETED\r\n", "freed some memory");
+
+unlink($config);
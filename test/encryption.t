@@ -0,0 +1,60 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 8;
+use Cwd;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+my $file = "/tmp/gocached-encrypted-slowlog-test.$$";
+my $keys = "/tmp/gocached-keys-test.$$";
+my $exe = getcwd . "/bin/gocached";
+unlink($file);
+
+sub write_keys {
+    open(my $fh, ">", $keys) or die "Unable to write $keys: $!";
+    print $fh @_;
+    close($fh);
+}
+
+sub file_contains {
+    my ($text) = @_;
+    open(my $fh, "<", $file) or die "Unable to read $file: $!";
+    local $/;
+    my $content = <$fh>;
+    close($fh);
+    return index($content, $text) >= 0;
+}
+
+write_keys("first 000102030405060708090a0b0c0d0e0f\n");
+my $server = new_gocached("-slowlog-latency 0 -slowlog-bytes 1 -slowlog-file $file -encryption-keys $keys");
+my $sock = $server->sock;
+
+print $sock "set secret:first 0 0 2\r\nab\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored a first value");
+
+# rotation: a new key is appended, the file is reloaded on SIGHUP
+write_keys("first 000102030405060708090a0b0c0d0e0f\n",
+           "second 101112131415161718191a1b1c1d1e1f\n");
+kill 1, $server->{pid};
+sleep(1);
+print $sock "set secret:second 0 0 2\r\ncd\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored a second value");
+mem_get_is($sock, "secret:second", "cd");
+
+ok(!file_contains("secret:"), "slow log written encrypted");
+`$exe -decrypt $file -encryption-keys $keys 2>/dev/null`;
+isnt($?, 0, "slow log still written doesn't decrypt as complete");
+
+# the records are ended when the server exits
+$server->stop;
+waitpid($server->{pid}, 0);
+my $plaintext = `$exe -decrypt $file -encryption-keys $keys`;
+is($?, 0, "slow log decrypted once the server exited");
+my @lines = grep { /msg="Slow command"/ } split(/\n/, $plaintext);
+is(scalar @lines, 3, "every slow command decrypted, before and after the rotation");
+like($lines[0], qr/keys=secret:first/, "slow command keys decrypted");
+
+unlink($file);
+unlink($keys);
@@ -1,7 +1,7 @@
 #!/usr/bin/perl
 
 use strict;
-use Test::More tests => 18;
+use Test::More tests => 23;
 use FindBin qw($Bin);
 use lib "$Bin/lib";
 use MemcachedTest;
@@ -52,6 +52,15 @@ print $sock "set boo 0 $expire 6\r\nbooval\r\n";
 is(scalar <$sock>, "STORED\r\n", "stored boo");
 mem_get_is($sock, "boo", undef, "now expired");
 
+print $sock "set boo 0 -1 6\r\nbooval\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored boo with a negative exptime");
+mem_get_is($sock, "boo", undef, "expired right away");
+
+print $sock "set boo 0 0 6\r\nbooval\r\ntouch boo -1\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored boo");
+is(scalar <$sock>, "TOUCHED\r\n", "touched boo with a negative exptime");
+mem_get_is($sock, "boo", undef, "expired once touched");
+
 print $sock "add add 0 2 6\r\naddval\r\n";
 is(scalar <$sock>, "STORED\r\n", "stored add");
 mem_get_is($sock, "add", "addval");
@@ -0,0 +1,38 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 8;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+sub latency_stats {
+    my $sock = shift;
+    print $sock "stats latency\r\n";
+    my $stats = {};
+    while (<$sock>) {
+        last if /^END/;
+        /^STAT (\S+) (\d+)/;
+        $stats->{$1} = $2;
+    }
+    return $stats;
+}
+
+my $server = new_gocached("");
+my $sock = $server->sock;
+
+print $sock "set foo 0 0 3\r\nbar\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored foo");
+mem_get_is($sock, "foo", "bar");
+print $sock "get foo missing\r\n";
+while (<$sock>) { last if /^END/; }
+
+my $stats = latency_stats($sock);
+is($stats->{command_set_count}, 1, "set commands recorded");
+is($stats->{command_get_count}, 2, "get commands recorded");
+is($stats->{storage_get_count}, 2, "get storage calls recorded, once for every command");
+ok($stats->{command_get_p50_us} <= $stats->{command_get_max_us}, "percentiles under the max");
+
+print $sock "stats latency reset\r\n";
+is(scalar <$sock>, "RESET\r\n", "latency stats reset");
+is(latency_stats($sock)->{command_set_count}, 0, "counts after reset");
@@ -12,8 +12,8 @@ use Cwd;
 my $builddir = getcwd;
 
 
-@EXPORT = qw(new_memcached sleep mem_get_is mem_gets mem_gets_is mem_stats
-             supports_sasl free_port);
+@EXPORT = qw(new_memcached new_gocached sleep mem_get_is mem_gets mem_gets_is
+             mem_stats supports_sasl free_port);
 
 sub sleep {
     my $n = shift;
@@ -215,6 +215,32 @@ sub new_memcached {
     croak("Failed to startup/connect to memcached server.");
 }
 
+# Start a gocached binary (as built by gb in bin/) with gocached style flags.
+sub new_gocached {
+    my ($args, $passed_port) = @_;
+    my $port = $passed_port || free_port();
+    my $exe = "$builddir/bin/gocached";
+    croak("gocached binary doesn't exist.  Haven't run './build' ?\n") unless -e $exe;
+
+    my $childpid = fork();
+    unless ($childpid) {
+        exec "$exe -port $port $args";
+        exit; # never gets here.
+    }
+
+    for (1..20) {
+        my $conn = IO::Socket::INET->new(PeerAddr => "127.0.0.1:$port");
+        if ($conn) {
+            return Memcached::Handle->new(pid  => $childpid,
+                                          conn => $conn,
+                                          host => '127.0.0.1',
+                                          port => $port);
+        }
+        select undef, undef, undef, 0.10;
+    }
+    croak("Failed to startup/connect to gocached server.");
+}
+
 ############################################################################
 package Memcached::Handle;
 sub new {
@@ -0,0 +1,48 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 13;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+my $server = new_gocached("-max-item-size 1024");
+my $sock = $server->sock;
+
+# oversized values are refused, and their data swallowed
+my $large = "x" x 1025;
+print $sock "set large 0 0 1025\r\n$large\r\n";
+is(scalar <$sock>, "SERVER_ERROR object too large for cache\r\n", "value over max-item-size refused");
+my $value = "x" x 1024;
+print $sock "set large 0 0 1024\r\n$value\r\n";
+is(scalar <$sock>, "STORED\r\n", "value at max-item-size stored");
+print $sock "set huge 0 0 4294967293 noreply\r\n";
+is(scalar <$sock>, "SERVER_ERROR object too large for cache\r\n", "huge value refused before reading it");
+print $sock "x" x 4096;
+close($sock);
+$sock = $server->new_sock;
+
+# keys up to 250 bytes, without control characters
+my $key = "k" x 250;
+print $sock "set $key 0 0 1\r\na\r\n";
+is(scalar <$sock>, "STORED\r\n", "250 bytes key stored");
+mem_get_is($sock, $key, "a");
+print $sock "set ${key}k 0 0 1\r\na\r\n";
+is(scalar <$sock>, "CLIENT_ERROR bad command line format\r\n", "251 bytes key refused");
+print $sock "set foo\x01 0 0 1\r\na\r\n";
+is(scalar <$sock>, "CLIENT_ERROR bad command line format\r\n", "control characters refused");
+print $sock "get foo ${key}k\r\n";
+is(scalar <$sock>, "CLIENT_ERROR bad command line format\r\n", "long keys refused by get");
+print $sock "delete ${key}k\r\n";
+is(scalar <$sock>, "CLIENT_ERROR bad command line format\r\n", "long keys refused by delete");
+print $sock "incr ${key}k 1\r\n";
+is(scalar <$sock>, "CLIENT_ERROR bad command line format\r\n", "long keys refused by incr");
+
+print $sock "cas foo 0 0 1\r\na\r\n";
+like(scalar <$sock>, qr/^CLIENT_ERROR/, "cas without unique refused");
+
+# the limit may change while running
+print $sock "config set max-item-size 2048\r\n";
+is(scalar <$sock>, "OK\r\n", "max-item-size changed");
+print $sock "set large 0 0 1025\r\n$large\r\n";
+is(scalar <$sock>, "STORED\r\n", "larger value stored");
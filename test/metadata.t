@@ -0,0 +1,27 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 7;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+my $server = new_gocached();
+my $sock = $server->sock;
+
+print $sock "set meta 3 0 5\r\nhello\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored meta");
+
+print $sock "mg meta v f s h l t\r\n";
+is(scalar <$sock>, "VA 5 f3 s5 h0 l0 t-1\r\n", "mg header before any fetch");
+is(scalar <$sock>, "hello\r\n", "mg value");
+
+mem_get_is({ sock => $sock, flags => 3 }, "meta", "hello");
+print $sock "mg meta h\r\n";
+is(scalar <$sock>, "HD h1\r\n", "hit before once fetched");
+
+print $sock "mg missing v\r\n";
+is(scalar <$sock>, "EN\r\n", "mg miss");
+
+print $sock "stats cachedump\r\n";
+like(scalar <$sock>, qr/^ITEM meta \[5 b; 0 s; \d+ created; \d+ accessed; 3 fetches; 3 fetched\]\r\n$/, "cachedump item access");
@@ -0,0 +1,38 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 9;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+my $metrics_port = free_port();
+my $server = new_gocached("-partitions 2 -metrics-listen 127.0.0.1:$metrics_port");
+my $sock = $server->sock;
+
+sub scrape {
+    my $http = IO::Socket::INET->new(PeerAddr => "127.0.0.1:$metrics_port")
+        or die "Unable to connect to the metrics server";
+    print $http "GET /metrics HTTP/1.0\r\n\r\n";
+    my $metrics = {};
+    while (<$http>) {
+        next if /^#/;
+        $metrics->{$1} = $2 if /^(gocached_\S+) (\S+)/;
+    }
+    return $metrics;
+}
+
+print $sock "set foo 0 0 3\r\nbar\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored foo");
+print $sock "add foo 0 0 3\r\nbaz\r\n";
+is(scalar <$sock>, "NOT_STORED\r\n", "foo not added");
+mem_get_is($sock, "foo", "bar");
+mem_get_is($sock, "missing", undef);
+
+my $metrics = scrape();
+is($metrics->{'gocached_commands_total{command="set",result="STORED"}'}, 1, "set counted");
+is($metrics->{'gocached_commands_total{command="add",result="NOT_STORED"}'}, 1, "failed add counted");
+is($metrics->{'gocached_command_duration_seconds_count{command="get"}'}, 2, "get latencies");
+is($metrics->{'gocached_get_hits_total'} . "/" . $metrics->{'gocached_get_misses_total'}, "1/1", "hits and misses");
+is($metrics->{'gocached_partition_items{partition="0"}'} + $metrics->{'gocached_partition_items{partition="1"}'},
+   1, "items by partition");
@@ -0,0 +1,37 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 10;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+my $server = new_gocached();
+my $watcher = $server->sock;
+my $writer = $server->new_sock;
+
+print $watcher "watch_mutations user: session:\r\n";
+is(scalar <$watcher>, "OK\r\n", "watching mutations");
+
+print $writer "set user:1 0 0 1\r\na\r\n";
+is(scalar <$writer>, "STORED\r\n", "stored user:1");
+like(scalar <$watcher>, qr/^ts=\d+ type=set key=user:1 exptime=0\r\n$/, "set event");
+
+# keys out of the watched prefixes are not streamed
+print $writer "set other 0 0 1\r\na\r\n";
+is(scalar <$writer>, "STORED\r\n", "stored other");
+
+print $writer "append user:1 0 0 1\r\nb\r\n";
+is(scalar <$writer>, "STORED\r\n", "appended to user:1");
+like(scalar <$watcher>, qr/^ts=\d+ type=set key=user:1 exptime=0\r\n$/, "append event");
+
+print $writer "touch session:1 10\r\n";
+is(scalar <$writer>, "NOT_FOUND\r\n", "touch of a missing key");
+
+print $writer "touch user:1 0\r\n";
+is(scalar <$writer>, "TOUCHED\r\n", "touched user:1");
+like(scalar <$watcher>, qr/^ts=\d+ type=touch key=user:1 exptime=0\r\n$/, "touch event");
+
+print $writer "delete user:1\r\n";
+<$writer>;
+like(scalar <$watcher>, qr/^ts=\d+ type=delete key=user:1\r\n$/, "delete event");
@@ -0,0 +1,44 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 7;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+my $server = new_gocached("-partitions 4");
+my $sock = $server->sock;
+
+my $stored = 0;
+for my $i (1..200) {
+    print $sock "set key$i 0 0 " . length("val$i") . "\r\nval$i\r\n";
+    $stored++ if scalar <$sock> eq "STORED\r\n";
+}
+is($stored, 200, "stored every key");
+
+print $sock "repartition 0\r\n";
+like(scalar <$sock>, qr/^CLIENT_ERROR/, "at least one partition");
+
+print $sock "repartition 13\r\n";
+is(scalar <$sock>, "OK\r\n", "repartitioning");
+
+my $found = 0;
+for my $i (1..200) {
+    print $sock "get key$i\r\n";
+    my $reply = scalar(<$sock>);
+    if ($reply =~ /^VALUE/) {
+        $found++ if scalar(<$sock>) eq "val$i\r\n";
+        $reply = scalar(<$sock>);
+    }
+}
+is($found, 200, "every key found after repartitioning");
+
+sleep(0.5);
+my $stats = mem_stats($sock, "partitions");
+is($stats->{partitions}, 13, "13 partitions");
+ok(!exists $stats->{migrating_partitions}, "migration finished");
+
+my $server1 = new_gocached("-partitions 1");
+my $sock1 = $server1->sock;
+print $sock1 "repartition 4\r\n";
+like(scalar <$sock1>, qr/^SERVER_ERROR partitions disabled/, "partitions disabled");
@@ -0,0 +1,48 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 10;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+my $file = "/tmp/gocached-slowlog-test.$$";
+unlink($file);
+
+sub slowlog_get {
+    my ($sock, $args) = @_;
+    print $sock "slowlog get$args\r\n";
+    my @entries;
+    while (<$sock>) {
+        last if /^END/;
+        push(@entries, $_);
+    }
+    return @entries;
+}
+
+my $server = new_gocached("-slowlog-latency 0 -slowlog-bytes 10 -slowlog-file $file");
+my $sock = $server->sock;
+
+print $sock "set small 0 0 2\r\nab\r\n";
+is(scalar <$sock>, "STORED\r\n", "small value stored");
+my $value = "x" x 20;
+print $sock "set large 0 0 20\r\n$value\r\n";
+is(scalar <$sock>, "STORED\r\n", "large value stored");
+mem_get_is($sock, "large", $value);
+
+my @entries = slowlog_get($sock, "");
+is(scalar @entries, 2, "large values logged");
+like($entries[0], qr/^SLOWLOG 1 \d+ \d+ 127\.0\.0\.1:\d+ get 20 1 large\r\n/, "newest entry first");
+like($entries[1], qr/^SLOWLOG 0 \d+ \d+ 127\.0\.0\.1:\d+ set 20 1 large\r\n/, "oldest entry last");
+is(scalar slowlog_get($sock, " 1"), 1, "entries requested");
+
+print $sock "slowlog reset\r\n";
+is(scalar <$sock>, "OK\r\n", "slow log reset");
+is(scalar slowlog_get($sock, ""), 0, "no entries after reset");
+
+open(my $fh, "<", $file) or die "Unable to read $file: $!";
+my @lines = grep { /msg="Slow command"/ } <$fh>;
+close($fh);
+is(scalar @lines, 2, "slow commands written to the file");
+
+unlink($file);
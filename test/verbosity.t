@@ -0,0 +1,28 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 6;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+sub verbosity {
+    my $sock = shift;
+    print $sock "config get verbosity\r\n";
+    my ($level) = (scalar <$sock>) =~ /^STAT verbosity (\d+)/;
+    is(scalar <$sock>, "END\r\n", "config get end");
+    return $level;
+}
+
+my $server = new_gocached("-vv");
+my $sock = $server->sock;
+
+is(verbosity($sock), 2, "-vv sets debug verbosity");
+
+print $sock "verbosity 1\r\n";
+is(scalar <$sock>, "OK\r\n", "verbosity changed");
+print $sock "verbosity 3 noreply\r\n";
+is(verbosity($sock), 3, "verbosity changed without reply");
+
+print $sock "verbosity loud\r\n";
+like(scalar <$sock>, qr/^CLIENT_ERROR/, "bad verbosity refused");
@@ -0,0 +1,36 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 9;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+my $server = new_gocached();
+my $watcher = $server->sock;
+my $writer = $server->new_sock;
+
+print $writer "set foo 0 0 6\r\nfooval\r\n";
+is(scalar <$writer>, "STORED\r\n", "stored foo");
+
+# watch before fetching, so no update goes unnoticed
+print $watcher "watch foo bar\r\n";
+is(scalar <$watcher>, "OK\r\n", "watching foo and bar");
+mem_get_is($watcher, "foo", "fooval");
+
+print $writer "append foo 0 0 3\r\nabc\r\n";
+is(scalar <$writer>, "STORED\r\n", "appended to foo");
+is(scalar <$watcher>, "INVALIDATE foo\r\n", "foo invalidated");
+
+# invalidations are one-shot, foo needs to be watched again
+print $writer "set foo 0 0 1\r\na\r\n";
+is(scalar <$writer>, "STORED\r\n", "stored foo again");
+
+print $watcher "unwatch bar\r\n";
+is(scalar <$watcher>, "OK\r\n", "unwatched bar");
+print $writer "set bar 0 0 1\r\nb\r\n";
+is(scalar <$writer>, "STORED\r\n", "stored bar");
+
+# nothing was pushed for foo nor bar
+print $watcher "get baz\r\n";
+is(scalar <$watcher>, "END\r\n", "no pending invalidations");
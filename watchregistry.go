@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sync"
+)
+
+// pending invalidations per session before falling back to INVALIDATE_ALL
+const invalidationsBuffer = 1024
+
+// Keys watched by client sessions, so they can keep a near cache of them. Any update
+// of a watched key pushes an "INVALIDATE <key>" line to each watching session and drops
+// the watch, the client is expected to watch the key again when fetching it back.
+// Clients should watch a key before fetching it, so no update can go unnoticed.
+type WatchRegistry struct {
+	mutex    sync.Mutex
+	watchers map[string]map[*Session]bool
+}
+
+// Invalidation state of a watching session
+type sessionWatches struct {
+	keys          map[string]bool
+	invalidations chan string
+	overflow      chan bool
+}
+
+func newWatchRegistry() *WatchRegistry {
+	return &WatchRegistry{watchers: make(map[string]map[*Session]bool)}
+}
+
+func (self *WatchRegistry) Watch(s *Session, keys []string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if s.watches == nil {
+		s.watches = &sessionWatches{make(map[string]bool), make(chan string, invalidationsBuffer), make(chan bool, 1)}
+		go s.pushInvalidations(s.watches)
+	}
+	for _, key := range keys {
+		sessions, present := self.watchers[key]
+		if !present {
+			sessions = make(map[*Session]bool)
+			self.watchers[key] = sessions
+		}
+		sessions[s] = true
+		s.watches.keys[key] = true
+	}
+}
+
+func (self *WatchRegistry) Unwatch(s *Session, keys []string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if s.watches != nil {
+		for _, key := range keys {
+			self.unwatch(s, key)
+		}
+	}
+}
+
+// Drop every watch of a session and stop its invalidations pusher
+func (self *WatchRegistry) Close(s *Session) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if s.watches != nil {
+		for key, _ := range s.watches.keys {
+			self.unwatch(s, key)
+		}
+		close(s.watches.invalidations)
+		s.watches = nil
+	}
+}
+
+// must be called with the mutex held
+func (self *WatchRegistry) unwatch(s *Session, key string) {
+	s.watches.keys[key] = false, false
+	if sessions, present := self.watchers[key]; present {
+		sessions[s] = false, false
+		if len(sessions) == 0 {
+			self.watchers[key] = nil, false
+		}
+	}
+}
+
+// Notify every session watching key that it changed. Never blocks, if a session can't
+// keep up its watches are dropped and it's told to invalidate everything.
+func (self *WatchRegistry) Invalidate(key string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	sessions, present := self.watchers[key]
+	if !present {
+		return
+	}
+	self.watchers[key] = nil, false
+	for s, _ := range sessions {
+		s.watches.keys[key] = false, false
+		select {
+		case s.watches.invalidations <- key:
+		default:
+			for key, _ := range s.watches.keys {
+				self.unwatch(s, key)
+			}
+			select {
+			case s.watches.overflow <- true:
+			default:
+			}
+		}
+	}
+}
+
+// UpdateListener implementation, any update invalidates the key
+func (self *WatchRegistry) Updated(msg UpdateMessage) {
+	self.Invalidate(msg.key)
+}
+
+// write the invalidations of a session, until the registry closes it
+func (s *Session) pushInvalidations(watches *sessionWatches) {
+	for {
+		select {
+		case key, ok := <-watches.invalidations:
+			if !ok {
+				return
+			}
+			s.writeLock.Lock()
+			s.conn.Write([]byte("INVALIDATE " + key + "\r\n"))
+			s.writeLock.Unlock()
+		case <-watches.overflow:
+			s.writeLock.Lock()
+			s.conn.Write([]byte("INVALIDATE_ALL\r\n"))
+			s.writeLock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"expiry"
+)
+
+// Implements an Expirer on a hierarchical timing wheel, with one schedule per key
+// and one second precision. Meant to be collected every second.
+type WheelExpiringStorage struct {
+	wheel        *expiry.Wheel
+	cacheStorage CacheStorage
+	clock        Clock // where the wheel starts turning when reset
+}
+
+func newWheelExpiringStorage(cacheStorage CacheStorage, clock Clock) *WheelExpiringStorage {
+	ws := &WheelExpiringStorage{cacheStorage: cacheStorage, clock: clock}
+	ws.Reset()
+	return ws
+}
+
+func (self *WheelExpiringStorage) Schedule(key string, exptime int64) {
+	if exptime == 0 {
+		self.wheel.Cancel(key)
+	} else {
+		self.wheel.Schedule(key, uint32(exptime))
+	}
+}
+
+func (self *WheelExpiringStorage) Unschedule(key string) {
+	self.wheel.Cancel(key)
+}
+
+func (self *WheelExpiringStorage) Collect(now int64) {
+	expired := 0
+	self.wheel.Advance(uint32(now), func(key string) {
+		if expireOrReschedule(self, self.cacheStorage, key) {
+			expired += 1
+		}
+	})
+	if expired > 0 {
+		logger.Verbose("Wheel collected", "expired", expired, "scheduled", self.wheel.Len())
+	}
+}
+
+func (self *WheelExpiringStorage) Reset() {
+	self.wheel = expiry.NewWheel(uint32(self.clock.Seconds()))
+}